@@ -0,0 +1,96 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// layer modes
+const (
+	LayerModeRead      = "read"
+	LayerModeWrite     = "write"
+	LayerModeReadWrite = "readwrite"
+)
+
+// access holds the operations a dataset denies. The zero value allows reads and writes.
+type access struct {
+	readDenied  bool
+	writeDenied bool
+}
+
+// accessFor combines the layer mode with the allow_read and allow_write flags of a dataset.
+// sc is nil for datasets that are not configured.
+func (dl *SnowflakeDataLayer) accessFor(sc *sourceConfig) access {
+	mode := confString(dl.config, LayerMode)
+	a := access{readDenied: mode == LayerModeWrite, writeDenied: mode == LayerModeRead}
+	if sc == nil {
+		return a
+	}
+	a.readDenied = a.readDenied || !sc.allowRead
+	// query datasets have no table to write to
+	a.writeDenied = a.writeDenied || !sc.allowWrite || sc.query != ""
+	return a
+}
+
+// implicitWrites reports whether datasets that are not configured can be written to
+func (dl *SnowflakeDataLayer) implicitWrites() bool {
+	return confBool(dl.config, ImplicitWrites) && confString(dl.config, LayerMode) != LayerModeRead
+}
+
+func (ds *Dataset) checkRead() common.LayerError {
+	if ds.access.readDenied {
+		return common.Err(fmt.Errorf("%w: dataset %s does not allow reads", ErrForbidden, ds.name), common.LayerNotSupported)
+	}
+	return nil
+}
+
+func (ds *Dataset) checkWrite() common.LayerError {
+	if ds.access.writeDenied {
+		return common.Err(fmt.Errorf("%w: dataset %s does not allow writes", ErrForbidden, ds.name), common.LayerNotSupported)
+	}
+	if len(ds.filters) > 0 {
+		return common.Errorf(common.LayerErrorBadParameter, "dataset %s cannot be written with filters", ds.name)
+	}
+	return nil
+}
+
+// implicitReadAllowed reports whether a table, named database.schema.table, can be read without dataset definition.
+// Patterns match case insensitive, and * also matches the dots between the name parts.
+// Names with a part that is not a valid identifier are never allowed, since they are used unquoted in statements.
+func (dl *SnowflakeDataLayer) implicitReadAllowed(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if !identifierPattern.MatchString(part) {
+			return false
+		}
+	}
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(strings.ToUpper(p), strings.ToUpper(name)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(confStrings(dl.config, ImplicitReadDeny)) {
+		return false
+	}
+	allow := confStrings(dl.config, ImplicitReadAllow)
+	return len(allow) == 0 || matches(allow)
+}
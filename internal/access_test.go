@@ -0,0 +1,166 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestAccess(t *testing.T) {
+	newLayer := func(t *testing.T, system map[string]any, definitions ...*common.DatasetDefinition) common.DataLayerService {
+		t.Helper()
+		conf, metrics, logger := testDeps()
+		for k, v := range system {
+			conf.NativeSystemConfig[k] = v
+		}
+		conf.DatasetDefinitions = definitions
+		dl, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dl.Stop(context.Background()) })
+		return dl
+	}
+	dataset := func(t *testing.T, dl common.DataLayerService, name string) common.Dataset {
+		t.Helper()
+		ds, lerr := dl.Dataset(name)
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		return ds
+	}
+	forbidden := func(t *testing.T, lerr common.LayerError, expected string) {
+		t.Helper()
+		if lerr == nil {
+			t.Fatal("expected forbidden error")
+		}
+		if !errors.Is(lerr.Underlying(), ErrForbidden) || lerr.Error() != expected {
+			t.Fatalf("unexpected error %v", lerr)
+		}
+	}
+
+	t.Run("should reject writes in read mode", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{LayerMode: LayerModeRead},
+			&common.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{}})
+		ds := dataset(t, dl, "people")
+		_, lerr := ds.Incremental(context.Background())
+		forbidden(t, lerr, "forbidden: dataset people does not allow writes")
+		_, lerr = ds.FullSync(context.Background(), common.BatchInfo{SyncId: "1", IsStartBatch: true})
+		forbidden(t, lerr, "forbidden: dataset people does not allow writes")
+
+		// implicit read datasets are resolved, but not writable either
+		ds = dataset(t, dl, "db.schema.table")
+		_, lerr = ds.Incremental(context.Background())
+		forbidden(t, lerr, "forbidden: dataset db.schema.table does not allow writes")
+	})
+	t.Run("should not resolve implicit write datasets in read mode", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{LayerMode: LayerModeRead})
+		_, lerr := dl.Dataset("people")
+		if lerr == nil || !errors.Is(lerr.Underlying(), ErrNoImplicitDataset) {
+			t.Fatalf("expected not found, got %v", lerr)
+		}
+	})
+	t.Run("should not resolve implicit write datasets when disabled", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{ImplicitWrites: false})
+		_, lerr := dl.Dataset("people")
+		if lerr == nil || !strings.HasPrefix(lerr.Error(), "dataset people not found") {
+			t.Fatalf("expected not found, got %v", lerr)
+		}
+		dataset(t, dl, "db.schema.table")
+	})
+	t.Run("should reject reads in write mode", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{LayerMode: LayerModeWrite},
+			&common.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{RawColumn: "ENTITY"}})
+		ds := dataset(t, dl, "people")
+		_, lerr := ds.Entities("", 10)
+		forbidden(t, lerr, "forbidden: dataset people does not allow reads")
+		_, lerr = ds.Changes("", 10, false)
+		forbidden(t, lerr, "forbidden: dataset people does not allow reads")
+	})
+	t.Run("should apply allow_read and allow_write per dataset", func(t *testing.T) {
+		dl := newLayer(t, nil,
+			&common.DatasetDefinition{DatasetName: "readonly", SourceConfig: map[string]any{AllowWrite: false}},
+			&common.DatasetDefinition{DatasetName: "writeonly", SourceConfig: map[string]any{AllowRead: false}})
+		_, lerr := dataset(t, dl, "readonly").Incremental(context.Background())
+		forbidden(t, lerr, "forbidden: dataset readonly does not allow writes")
+		_, lerr = dataset(t, dl, "writeonly").Entities("", 10)
+		forbidden(t, lerr, "forbidden: dataset writeonly does not allow reads")
+	})
+	t.Run("should not let a dataset allow what the layer mode denies", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{LayerMode: LayerModeRead},
+			&common.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{AllowWrite: true}})
+		_, lerr := dataset(t, dl, "people").Incremental(context.Background())
+		forbidden(t, lerr, "forbidden: dataset people does not allow writes")
+	})
+	t.Run("should reject invalid flags", func(t *testing.T) {
+		err := validateDatasetDefinition(nil, &common.DatasetDefinition{
+			DatasetName:  "people",
+			SourceConfig: map[string]any{AllowRead: "no", AllowWrite: 0},
+		})
+		if err == nil || !strings.Contains(err.Error(), "allow_read must be a boolean, got string") ||
+			!strings.Contains(err.Error(), "allow_write must be a boolean, got int") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("should only resolve allowed implicit reads", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{
+			ImplicitReadAllow: []any{"analytics.public.*", "SHARED.*"},
+			ImplicitReadDeny:  []any{"*.*.SECRET_*"},
+		})
+		for _, name := range []string{"ANALYTICS.PUBLIC.PEOPLE", "analytics.public.people", "shared.raw.events"} {
+			dataset(t, dl, name)
+		}
+		for _, name := range []string{"ANALYTICS.PRIVATE.PEOPLE", "analytics.public.secret_people", "other.public.people",
+			"shared.raw.events;drop table x", "shared.raw.events where true", "shared..events"} {
+			_, lerr := dl.Dataset(name)
+			if lerr == nil || !errors.Is(lerr.Underlying(), ErrNotFound) || lerr.Error() != "dataset "+name+" not found" {
+				t.Fatalf("expected %s not found, got %v", name, lerr)
+			}
+		}
+	})
+	t.Run("should check implicit reads of write mode names on the resolved table", func(t *testing.T) {
+		dl := newLayer(t, map[string]any{
+			ImplicitReadAllow: []any{"testdb.testschema.*"},
+			ImplicitReadDeny:  []any{"*.*.SECRET_*"},
+		})
+		// names that are not database.schema.table resolve to a table in the configured schema
+		for _, name := range []string{"secret_people", "secret.people"} {
+			ds := dataset(t, dl, name)
+			_, lerr := ds.Entities("", 10)
+			forbidden(t, lerr, "forbidden: dataset "+name+" does not allow reads")
+			if ds.(*Dataset).access.writeDenied {
+				t.Fatalf("expected %s to stay writable", name)
+			}
+		}
+		for _, name := range []string{"people", "public.people"} {
+			if ds := dataset(t, dl, name); ds.(*Dataset).access.readDenied {
+				t.Fatalf("expected reads of %s to be allowed", name)
+			}
+		}
+	})
+	t.Run("should reject invalid patterns at startup", func(t *testing.T) {
+		conf, metrics, logger := testDeps()
+		conf.NativeSystemConfig[ImplicitReadDeny] = []any{"DB.[A"}
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err == nil || err.Error() != `invalid implicit_read_deny entry "DB.[A": syntax error in pattern` {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
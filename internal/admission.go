@@ -0,0 +1,183 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+var defaultAdmissionTimeout = 30 * time.Second
+
+// semaphore limits the number of concurrent holders. Waiters are admitted in arrival order,
+// so a steady stream of new requests cannot starve a waiting one. A limit of 0 means unlimited.
+type semaphore struct {
+	mu      sync.Mutex
+	limit   int
+	used    int
+	waiters list.List // of chan struct{}
+}
+
+func (s *semaphore) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.limit <= 0 || (s.used < s.limit && s.waiters.Len() == 0) {
+		s.used++
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// admitted while giving up, pass the slot on
+			s.mu.Unlock()
+			s.release()
+		default:
+			s.waiters.Remove(elem)
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.admitWaiters()
+}
+
+// setLimit changes the limit. Holders above a lowered limit keep their slots.
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.admitWaiters()
+}
+
+func (s *semaphore) admitWaiters() {
+	for s.waiters.Len() > 0 && (s.limit <= 0 || s.used < s.limit) {
+		ready := s.waiters.Remove(s.waiters.Front()).(chan struct{})
+		s.used++
+		close(ready)
+	}
+}
+
+// admissionControl holds the semaphores of the layer. It outlives configuration updates,
+// so that requests admitted under an old configuration are still counted.
+type admissionControl struct {
+	global   semaphore
+	datasets sync.Map // dataset name -> *semaphore
+}
+
+// admission is the admission control of one dataset. A nil admission admits everything.
+type admission struct {
+	dataset string
+	global  *semaphore
+	local   *semaphore // nil for datasets that are not configured
+	timeout time.Duration
+	logger  common.Logger
+	metrics common.Metrics
+}
+
+// admissionFor returns the admission control of a configured dataset, with its dataset limit.
+// The dataset limit is max_concurrent_requests in the source config, or
+// max_concurrent_requests_per_dataset in the system config.
+func (dl *SnowflakeDataLayer) admissionFor(name string, sourceConfig map[string]any) *admission {
+	localLimit := confInt(dl.config, MaxConcurrentRequestsPerDataset)
+	if v, ok := sourceConfig[MaxConcurrentRequests]; ok {
+		localLimit, _ = asInt(v) // validated in UpdateConfiguration
+	}
+	s, _ := dl.admission.datasets.LoadOrStore(name, &semaphore{})
+	local := s.(*semaphore)
+	local.setLimit(localLimit)
+	a := dl.implicitAdmission(name)
+	a.local = local
+	return a
+}
+
+// implicitAdmission returns the admission control of a dataset that is not configured. It only takes
+// a global slot, so that the semaphores of the layer do not grow with every requested table name.
+func (dl *SnowflakeDataLayer) implicitAdmission(name string) *admission {
+	return &admission{
+		dataset: name,
+		global:  &dl.admission.global,
+		timeout: confDuration(dl.config, AdmissionTimeout),
+		logger:  dl.logger,
+		metrics: dl.metrics,
+	}
+}
+
+// admit waits until the request fits in both the dataset and the global limit. The dataset slot is
+// taken first, so that waiting for one dataset does not block the global slots of other datasets.
+// If the request is not admitted within the admission timeout, a RetryableError wrapping ErrBusy is returned.
+func (a *admission) admit(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	if a.local != nil {
+		if err := a.local.acquire(ctx); err != nil {
+			return nil, a.busy(err, "dataset")
+		}
+	}
+	if err := a.global.acquire(ctx); err != nil {
+		a.releaseLocal()
+		return nil, a.busy(err, "global")
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.global.release()
+			a.releaseLocal()
+		})
+	}, nil
+}
+
+func (a *admission) releaseLocal() {
+	if a.local != nil {
+		a.local.release()
+	}
+}
+
+func (a *admission) busy(err error, scope string) error {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		// the caller gave up
+		return err
+	}
+	a.logger.Warn("Rejecting request, too many concurrent requests", "dataset", a.dataset, "limit", scope)
+	tags := []string{"dataset:" + a.dataset, "operation:admit", "limit:" + scope}
+	if err := a.metrics.Incr("snowflake.admission.rejected", tags, 1); err != nil {
+		a.logger.Warn("Error with metrics", "error", err.Error())
+	}
+	return &RetryableError{
+		Err:        fmt.Errorf("%w: %s limit reached for dataset %s, waited %s", ErrBusy, scope, a.dataset, a.timeout),
+		RetryAfter: a.timeout,
+	}
+}
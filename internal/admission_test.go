@@ -0,0 +1,189 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+func TestSemaphore(t *testing.T) {
+	waitForWaiters := func(s *semaphore, n int) {
+		for {
+			s.mu.Lock()
+			l := s.waiters.Len()
+			s.mu.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("should admit waiters in arrival order", func(t *testing.T) {
+		s := &semaphore{limit: 1}
+		if err := s.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		admitted := make(chan int, 3)
+		for i := 1; i <= 3; i++ {
+			go func(i int) {
+				if err := s.acquire(context.Background()); err == nil {
+					admitted <- i
+				}
+			}(i)
+			waitForWaiters(s, i)
+		}
+		for i := 1; i <= 3; i++ {
+			s.release()
+			if got := <-admitted; got != i {
+				t.Fatalf("expected waiter %d to be admitted, got %d", i, got)
+			}
+		}
+	})
+
+	t.Run("should not lose slots of waiters that give up", func(t *testing.T) {
+		s := &semaphore{limit: 1}
+		_ = s.acquire(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := s.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+		s.release()
+		if s.used != 0 || s.waiters.Len() != 0 {
+			t.Fatalf("expected empty semaphore, got used %d, waiters %d", s.used, s.waiters.Len())
+		}
+	})
+
+	t.Run("should admit waiters when the limit is raised", func(t *testing.T) {
+		s := &semaphore{limit: 1}
+		_ = s.acquire(context.Background())
+		done := make(chan error)
+		go func() { done <- s.acquire(context.Background()) }()
+		waitForWaiters(s, 1)
+		s.setLimit(0)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAdmission(t *testing.T) {
+	conf, metrics, logger := testDeps()
+	conf.NativeSystemConfig[MaxConcurrentRequests] = float64(3)
+	conf.NativeSystemConfig[MaxConcurrentRequestsPerDataset] = float64(1)
+	conf.NativeSystemConfig[AdmissionTimeout] = "20ms"
+	dl := &SnowflakeDataLayer{config: conf, logger: logger, metrics: metrics}
+	// set by UpdateConfiguration
+	dl.admission.global.setLimit(3)
+
+	t.Run("should reject requests over the dataset limit with a busy error", func(t *testing.T) {
+		a := dl.admissionFor("people", nil)
+		release, err := a.admit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.admit(context.Background())
+		if !errors.Is(err, ErrBusy) || !errors.Is(err, ErrRetryable) {
+			t.Fatalf("expected busy error, got %v", err)
+		}
+		if err.Error() != "layer busy: dataset limit reached for dataset people, waited 20ms: retry after 20ms" {
+			t.Fatalf("unexpected message %s", err.Error())
+		}
+		if metrics.(*testMetrics).metrics["snowflake.admission.rejected"] != 1 {
+			t.Fatalf("expected one counted rejection, got %v", metrics.(*testMetrics).metrics)
+		}
+		release()
+		release() // releasing twice must not free a second slot
+		release, err = a.admit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if a.local.used != 0 || a.global.used != 0 {
+			t.Fatalf("expected all slots to be free, got %d, %d", a.local.used, a.global.used)
+		}
+	})
+
+	t.Run("should apply the global limit across datasets", func(t *testing.T) {
+		var releases []func()
+		for _, name := range []string{"a", "b", "c"} {
+			release, err := dl.admissionFor(name, nil).admit(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			releases = append(releases, release)
+		}
+		_, err := dl.admissionFor("d", nil).admit(context.Background())
+		if !errors.Is(err, ErrBusy) {
+			t.Fatalf("expected busy error, got %v", err)
+		}
+		if a := dl.admissionFor("d", nil); a.local.used != 0 {
+			t.Fatal("expected dataset slot to be returned when the global limit is reached")
+		}
+		for _, release := range releases {
+			release()
+		}
+	})
+
+	t.Run("should only take a global slot for datasets that are not configured", func(t *testing.T) {
+		var releases []func()
+		for i := 0; i < 3; i++ {
+			release, err := dl.implicitAdmission("db.schema.table").admit(context.Background())
+			if err != nil {
+				t.Fatalf("expected no dataset limit, got %v", err)
+			}
+			releases = append(releases, release)
+		}
+		_, err := dl.implicitAdmission("db.schema.other").admit(context.Background())
+		if err == nil || err.Error() != "layer busy: global limit reached for dataset db.schema.other, waited 20ms: retry after 20ms" {
+			t.Fatalf("expected global busy error, got %v", err)
+		}
+		for _, release := range releases {
+			release()
+		}
+		if _, found := dl.admission.datasets.Load("db.schema.table"); found {
+			t.Fatal("expected no dataset semaphore for a dataset that is not configured")
+		}
+	})
+
+	t.Run("should use the dataset override from source config", func(t *testing.T) {
+		a := dl.admissionFor("places", map[string]any{MaxConcurrentRequests: float64(2)})
+		r1, err := a.admit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r2, err := a.admit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r1()
+		r2()
+	})
+
+	t.Run("should reject invalid limits", func(t *testing.T) {
+		err := validateDatasetDefinitions(conf, []*common.DatasetDefinition{
+			{DatasetName: "places", SourceConfig: map[string]any{MaxConcurrentRequests: -1}},
+		})
+		if err == nil {
+			t.Fatal("expected validation error")
+		}
+	})
+}
@@ -16,6 +16,7 @@ package layer
 
 import (
 	"fmt"
+	"strings"
 
 	common "github.com/mimiro-io/common-datalayer"
 )
@@ -65,6 +66,8 @@ func ColMappings(mapping *common.DatasetDefinition) (string, string, string, str
 	return columns[2:], columnTypes[2:], colExtractions[2:], colAssignments[2:], srcColExtractions[2:]
 }
 
+// ColumnDDL lists the mapped columns of an outgoing mapping. Columns of mappings with a datatype are
+// cast to the matching snowflake type, so that views and external tables are read with explicit types.
 func ColumnDDL(config *common.OutgoingMappingConfig) string {
 	res := ""
 	if config == nil || config.PropertyMappings == nil {
@@ -74,7 +77,34 @@ func ColumnDDL(config *common.OutgoingMappingConfig) string {
 		if len(res) > 0 {
 			res = res + ", "
 		}
-		res = res + mapping.Property
+		if t := outgoingTypes[mapping.Datatype]; t != "" {
+			res = fmt.Sprintf("%s%s::%s AS %s", res, mapping.Property, t, mapping.Property)
+		} else {
+			res = res + mapping.Property
+		}
 	}
 	return res
 }
+
+// entityHashExpr computes a content hash over the parts of an entity that constitute a change.
+// snowflake orders object keys, so the json representation is stable for equal entities.
+const entityHashExpr = `SHA2(TO_JSON(OBJECT_CONSTRUCT('props', $1:props, 'refs', $1:refs, 'deleted', coalesce($1:deleted::boolean, false))))`
+
+// WithHashColumn extends the column mappings produced by ColMappings with a hash column,
+// which is used for change detection in incremental loads.
+func WithHashColumn(columns, columnTypes, colExtractions, colAssignments, srcColExtractions string) (string, string, string, string, string) {
+	return columns + ", hash",
+		columnTypes + ", hash varchar",
+		colExtractions + ", " + entityHashExpr + " as hash",
+		colAssignments + ", latest.hash = src.hash",
+		srcColExtractions + ", src.hash"
+}
+
+// srcColumns prefixes every column in a comma separated column list with src.
+func srcColumns(columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, c := range cols {
+		cols[i] = "src." + c
+	}
+	return strings.Join(cols, ", ")
+}
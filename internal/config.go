@@ -15,9 +15,8 @@
 package layer
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"strconv"
 	"strings"
 
 	common "github.com/mimiro-io/common-datalayer"
@@ -29,12 +28,23 @@ const (
 	Connection CtxKey = iota
 	Recorded
 	Closed
+	BatchKey
+	// QueryTag holds the *queryTag of the session in Connection
+	QueryTag
 )
 
 var (
 	ErrNoImplicitDataset = common.Errorf(common.LayerErrorBadParameter, "no implicit mapping for dataset")
 	ErrQuery             = common.Errorf(common.LayerErrorInternal, "failed to query snowflake")
-	ErrHeadroom          = common.Errorf(common.LayerErrorInternal, "MemoryGuard: headroom too low, rejecting request")
+	// ErrHeadroom is returned as RetryableError, see memoryGuard
+	ErrHeadroom = errors.New("MemoryGuard: headroom too low, rejecting request")
+	// ErrBusy is returned as RetryableError when a request is not admitted in time, see admission
+	ErrBusy = errors.New("layer busy")
+	// ErrForbidden is returned as LayerNotSupported error when a dataset does not allow an operation, see layer_mode
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotFound matches errors for datasets and tables that do not exist, or that the layer cannot access.
+	// It is returned as LayerErrorBadParameter, common-datalayer has no not found error type
+	ErrNotFound = errors.New("not found")
 )
 
 const (
@@ -45,63 +55,101 @@ const (
 	RawColumn   = "raw_column"
 	SinceColumn = "since_column"
 	LatestTable = "latest_table"
+	// LatestStrategy selects how the latest table is maintained: merge (default), view or dynamic_table
+	LatestStrategy = "latest_strategy"
+	// LatestTargetLag is the target lag of the latest dynamic table, e.g. "1 minute"
+	LatestTargetLag = "latest_target_lag"
+	// ChangeDetection enables hash based deduplication of incremental writes
+	ChangeDetection = "change_detection"
+	// IdempotentBatches records a key for every loaded incremental batch, so that replays are not loaded twice
+	IdempotentBatches = "idempotent_batches"
+	// IngestMode selects how incremental writes are loaded: copy (default) or pipe
+	IngestMode = "ingest_mode"
+	// Query is a SELECT statement that a dataset reads instead of a table, e.g. a join or a lateral flatten
+	Query = "query"
+	// QueryParams are the values of the ? placeholders in Query
+	QueryParams = "query_params"
+	// Where is a static predicate of all reads of a dataset, e.g. "tenant = 'x'"
+	Where = "where"
+	// FilterColumns lists the columns that reads can filter on, see Dataset.withFilters
+	FilterColumns = "filter_columns"
+	// AllowRead and AllowWrite can deny reads or writes of a dataset, both default true
+	AllowRead  = "allow_read"
+	AllowWrite = "allow_write"
+
+	// table options, applied when the layer creates tables
+	ClusterBy         = "cluster_by"
+	LatestClusterBy   = "latest_cluster_by"
+	Transient         = "transient"
+	DataRetentionDays = "data_retention_days"
+	TableComment      = "table_comment"
+	TableTags         = "table_tags"
 
 	// native system config
-	MemoryHeadroom      = "memory_headroom"
-	SnowflakeDB         = "snowflake_db"
-	SnowflakeSchema     = "snowflake_schema"
-	SnowflakeUser       = "snowflake_user"
-	SnowflakeAccount    = "snowflake_account"
-	SnowflakeWarehouse  = "snowflake_warehouse"
+	MemoryHeadroom     = "memory_headroom"
+	SnowflakeDB        = "snowflake_db"
+	SnowflakeSchema    = "snowflake_schema"
+	SnowflakeUser      = "snowflake_user"
+	SnowflakeAccount   = "snowflake_account"
+	SnowflakeWarehouse = "snowflake_warehouse"
+	// SnowflakePrivateKey is the base64 encoded private key of the snowflake user
 	SnowflakePrivateKey = "snowflake_private_key"
+	// SnowflakePrivateKeyFile is the path to a file with the private key, e.g. a mounted kubernetes secret
+	SnowflakePrivateKeyFile = "snowflake_private_key_file"
+	// SnowflakePrivateKeySecret is the name of the private key in the secret provider of the layer
+	SnowflakePrivateKeySecret = "snowflake_private_key_secret"
+	// DiscoverTables enables listing of snowflake tables in DatasetDescriptions, default true
+	DiscoverTables = "discover_tables"
+	// DiscoverySchemas lists additional schemas, in database.schema form, to discover tables in
+	DiscoverySchemas = "discovery_schemas"
+	// DiscoveryTTL is how long discovered tables are cached, e.g. "5m"
+	DiscoveryTTL = "discovery_ttl"
+	// PreflightMode controls the permission checks at startup: off, warn (default) or strict
+	PreflightMode = "preflight_mode"
+	// HealthPort is the port of the layer's own health endpoints. If not set, they are not served
+	HealthPort = "health_port"
+	// ReadinessInterval is how often snowflake connectivity is checked for the readiness endpoint, e.g. "30s"
+	ReadinessInterval = "readiness_interval"
+	// FullSyncTimeout is how long a full sync may run before the layer reports it as stuck, e.g. "6h"
+	FullSyncTimeout = "full_sync_timeout"
+	// MemoryRetryAfter is the back-off hint of memory guard rejections, e.g. "30s"
+	MemoryRetryAfter = "memory_retry_after"
+	// MaxConcurrentRequests limits the open writers and readers of the layer, 0 means unlimited.
+	// In a source config, it overrides max_concurrent_requests_per_dataset for that dataset
+	MaxConcurrentRequests = "max_concurrent_requests"
+	// MaxConcurrentRequestsPerDataset limits the open writers and readers of each dataset, 0 means unlimited
+	MaxConcurrentRequestsPerDataset = "max_concurrent_requests_per_dataset"
+	// AdmissionTimeout is how long a request waits for a free slot before it is rejected, e.g. "30s"
+	AdmissionTimeout = "admission_timeout"
+	// BatchSize is the number of entities per uploaded file, default 50000. Also valid in a source config
+	BatchSize = "batch_size"
+	// BatchKeyTTL is how long the key of an idempotent batch is kept, e.g. "168h". Replays after that are loaded again
+	BatchKeyTTL = "batch_key_ttl"
+	// MaxFileBytes caps the uncompressed bytes per uploaded file, 0 (default) means no limit. An entity that is larger
+	// on its own is written to a file of its own. Also valid in a source config
+	MaxFileBytes = "max_file_bytes"
+	// GzipLevel is the compression level of uploaded files, -2 to 9, default -1 (gzip default). Also valid in a source config
+	GzipLevel = "gzip_level"
+	// MaxFilesPerCopy limits the files per COPY INTO of incremental loads, 1 to 1000 (default). Also valid in a source config
+	MaxFilesPerCopy = "max_files_per_copy"
+	// LayerMode restricts the layer to read or write operations: read, write or readwrite (default)
+	LayerMode = "layer_mode"
+	// ImplicitWrites enables writes to datasets that are not configured, by dataset name, default true
+	ImplicitWrites = "implicit_writes"
+	// ImplicitReadAllow lists glob patterns, like "ANALYTICS.PUBLIC.*", of tables that can be read by
+	// database.schema.table name without dataset definition. If not set, all tables are allowed
+	ImplicitReadAllow = "implicit_read_allow"
+	// ImplicitReadDeny lists glob patterns of tables that cannot be read by name, it takes precedence over ImplicitReadAllow
+	ImplicitReadDeny = "implicit_read_deny"
+	// TracingExporter selects where trace spans are sent: none (default), stdout or otlp
+	TracingExporter = "tracing_exporter"
+	// TracingEndpoint is the url of the otlp http endpoint, e.g. "http://localhost:4318".
+	// If not set, the OTEL_EXPORTER_OTLP_* environment variables are used
+	TracingEndpoint = "tracing_endpoint"
+	// TracingSampleRatio is the share of requests that are traced, between 0 and 1. Default 1
+	TracingSampleRatio = "tracing_sample_ratio"
 )
 
-func sysConfStr(conf *common.Config, key string) string {
-	v, ok := conf.NativeSystemConfig[key].(string)
-
-	if !ok {
-		// should never happen, since we assume all config is validated already.
-		// if it does, improve the validateConfig function
-		panic(fmt.Sprintf("expected string value for %s, got %T", key, conf.NativeSystemConfig[key]))
-	}
-
-	return v
-}
-
-// TODO: use BuildNativeEnvOverrides from common-datalayer
-func EnvOverrides(config *common.Config) error {
-	if v, ok := os.LookupEnv("MEMORY_HEADROOM"); ok {
-		config.NativeSystemConfig[MemoryHeadroom] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_DB"); ok {
-		config.NativeSystemConfig[SnowflakeDB] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_SCHEMA"); ok {
-		config.NativeSystemConfig[SnowflakeSchema] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_USER"); ok {
-		config.NativeSystemConfig[SnowflakeUser] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_ACCOUNT"); ok {
-		config.NativeSystemConfig[SnowflakeAccount] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_WAREHOUSE"); ok {
-		config.NativeSystemConfig[SnowflakeWarehouse] = v
-	}
-	if v, ok := os.LookupEnv("SNOWFLAKE_PRIVATE_KEY"); ok {
-		config.NativeSystemConfig[SnowflakePrivateKey] = v
-	}
-	if v, ok := os.LookupEnv("LATEST_TABLE"); ok {
-		boolValue, err := strconv.ParseBool(v)
-		if err != nil {
-			return err
-		}
-
-		config.NativeSystemConfig[LatestTable] = boolValue
-	}
-	return nil
-}
-
 func validateConfig(conf *common.Config) error {
 	if conf.LayerServiceConfig == nil {
 		return fmt.Errorf("missing required layer_config block")
@@ -109,65 +157,58 @@ func validateConfig(conf *common.Config) error {
 	if conf.NativeSystemConfig == nil {
 		return fmt.Errorf("missing required system_config block")
 	}
-	type p struct {
-		v any
-		n string
+	var err error
+	// the layer_config values are not in the settings table
+	if conf.LayerServiceConfig.ServiceName == "" {
+		err = errors.Join(err, fmt.Errorf("missing required config value service_name"))
 	}
-	reqVal := func(vals ...p) error {
-		for _, v := range vals {
-			if v.v == nil || v.v == "" {
-				return fmt.Errorf("missing required config value %v", v.n)
-			}
-		}
-		return nil
+	if conf.LayerServiceConfig.Port == "" {
+		err = errors.Join(err, fmt.Errorf("missing required config value port"))
+	}
+	err = errors.Join(err, validateSettings(conf.NativeSystemConfig))
+	if confString(conf, SnowflakePrivateKey) == "" && confString(conf, SnowflakePrivateKeyFile) == "" &&
+		confString(conf, SnowflakePrivateKeySecret) == "" {
+		err = errors.Join(err, errMissingPrivateKey)
 	}
-	return reqVal(
-		p{conf.LayerServiceConfig.ServiceName, "service_name"},
-		p{conf.LayerServiceConfig.Port, "port"},
-		p{conf.NativeSystemConfig[SnowflakeDB], SnowflakeDB},
-		p{conf.NativeSystemConfig[SnowflakeSchema], SnowflakeSchema},
-		p{conf.NativeSystemConfig[SnowflakeUser], SnowflakeUser},
-		p{conf.NativeSystemConfig[SnowflakeAccount], SnowflakeAccount},
-		p{conf.NativeSystemConfig[SnowflakeWarehouse], SnowflakeWarehouse},
-		p{conf.NativeSystemConfig[SnowflakePrivateKey], SnowflakePrivateKey},
-	)
+	return err
 }
 
 // UpdateConfiguration implements common_datalayer.DataLayerService.
 // we only dynamically update the mapping config.
 // the rest of the config is static and loaded in NewSnowflakeDataLayer
 func (dl *SnowflakeDataLayer) UpdateConfiguration(config *common.Config) common.LayerError {
-	existingDatasets := map[string]bool{}
-	// update existing datasets
-	for k, v := range dl.datasets {
-		for _, dsd := range config.DatasetDefinitions {
-			if k == dsd.DatasetName {
-				existingDatasets[k] = true
-				v.sourceConfig = dsd.SourceConfig
-				v.datasetDefinition = dsd
-			}
-		}
+	// reject the whole update if any definition is invalid, the previous definitions stay active
+	if err := validateDatasetDefinitions(dl.config, config.DatasetDefinitions); err != nil {
+		return common.Err(err, common.LayerErrorBadParameter)
 	}
-	// remove deleted datasets
-	for k := range dl.datasets {
-		if _, found := existingDatasets[k]; !found {
-			delete(dl.datasets, k)
-		}
+	if err := dl.explainQueries(config.DatasetDefinitions); err != nil {
+		return common.Err(err, common.LayerErrorBadParameter)
 	}
+	dl.updateLock.Lock()
+	defer dl.updateLock.Unlock()
+	dl.admission.global.setLimit(confInt(dl.config, MaxConcurrentRequests))
 
-	// add new datasets
+	// build a new registry instead of changing the current one. requests that already resolved
+	// a dataset keep the definition they started with
+	datasets := map[string]*Dataset{}
 	for _, dsd := range config.DatasetDefinitions {
-		if _, found := existingDatasets[dsd.DatasetName]; !found {
-			dl.datasets[dsd.DatasetName] = &Dataset{
-				logger:            dl.logger,
-				name:              dsd.DatasetName,
-				sourceConfig:      dsd.SourceConfig,
-				db:                dl.db,
-				datasetDefinition: dsd,
-			}
+		sc, _ := parseSourceConfig(dsd) // validated above
+		datasets[dsd.DatasetName] = &Dataset{
+			logger:            dl.logger,
+			name:              dsd.DatasetName,
+			sourceConfig:      dsd.SourceConfig,
+			db:                dl.db,
+			datasetDefinition: dsd,
+			state:             dl.loadStates.get(dsd.DatasetName),
+			guard:             dl.memoryGuard(),
+			admission:         dl.admissionFor(dsd.DatasetName, dsd.SourceConfig),
+			service:           dl.serviceName(),
+			load:              dl.loadConfigFor(dsd.SourceConfig),
+			access:            dl.accessFor(sc),
+			fullSyncTimeout:   confDuration(dl.config, FullSyncTimeout),
 		}
 	}
-
+	dl.datasets.Store(&datasetRegistry{datasets: datasets})
 	return nil
 }
 
@@ -176,6 +217,11 @@ func (dl *SnowflakeDataLayer) UpdateConfiguration(config *common.Config) common.
 func implicitMapping(name string) (*common.DatasetDefinition, error) {
 	tokens := strings.Split(name, ".")
 	if len(tokens) == 3 {
+		for _, t := range tokens {
+			if !identifierPattern.MatchString(t) {
+				return nil, fmt.Errorf("%w %s. %q is not a valid snowflake identifier", ErrNoImplicitDataset, name, t)
+			}
+		}
 		return &common.DatasetDefinition{
 			DatasetName: name,
 			SourceConfig: map[string]any{
@@ -16,6 +16,8 @@ package layer
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	common "github.com/mimiro-io/common-datalayer"
@@ -51,7 +53,7 @@ func TestConfig(t *testing.T) {
 		if ds == nil {
 			t.Fatal("dataset is nil")
 		}
-		if len(ds.MetaData()) != 0 {
+		if len(ds.(*Dataset).sourceConfig) != 0 {
 			t.Fatal("empty here means non implicit")
 		}
 	})
@@ -68,7 +70,7 @@ func TestConfig(t *testing.T) {
 		if ds == nil {
 			t.Fatal("dataset is nil")
 		}
-		if len(ds.MetaData()) != 0 {
+		if len(ds.(*Dataset).sourceConfig) != 0 {
 			t.Fatal("empty here means non implicit")
 		}
 
@@ -85,7 +87,7 @@ func TestConfig(t *testing.T) {
 		if ds == nil {
 			t.Fatal("dataset is nil")
 		}
-		if ds.MetaData()["test"] != "test" {
+		if ds.(*Dataset).sourceConfig["test"] != "test" {
 			t.Fatal("source config not updated")
 		}
 	})
@@ -102,7 +104,7 @@ func TestConfig(t *testing.T) {
 		if ds == nil {
 			t.Fatal("dataset is nil")
 		}
-		if len(ds.MetaData()) != 0 {
+		if len(ds.(*Dataset).sourceConfig) != 0 {
 			t.Fatal("empty here means non implicit")
 		}
 
@@ -116,13 +118,143 @@ func TestConfig(t *testing.T) {
 		if ds == nil {
 			t.Fatal("dataset is nil")
 		}
-		if len(ds.MetaData()) == 0 {
+		if len(ds.(*Dataset).sourceConfig) == 0 {
 			t.Fatal("implicit config expected")
 		}
-		if ds.MetaData()["raw_column"] != "ENTITY" {
+		if ds.(*Dataset).sourceConfig["raw_column"] != "ENTITY" {
 			t.Fatal("implicit config expected")
 		}
 	})
+	t.Run("should reject invalid dataset definitions with all problems", func(t *testing.T) {
+		setup()
+		if subject.UpdateConfiguration(&common.Config{
+			DatasetDefinitions: []*common.DatasetDefinition{{DatasetName: "valid"}},
+		}) != nil {
+			t.Fatal("failed to add dataset definition")
+		}
+		err := subject.UpdateConfiguration(&common.Config{
+			DatasetDefinitions: []*common.DatasetDefinition{
+				{DatasetName: "a", SourceConfig: map[string]any{LatestTable: "true", TableName: 1}},
+				{DatasetName: "b", SourceConfig: map[string]any{Schema: "my schema", LatestStrategy: "sometimes",
+					FilterColumns: []any{"country", "1=1 or x"}},
+					IncomingMappingConfig: &common.IncomingMappingConfig{PropertyMappings: []*common.EntityToItemPropertyMapping{
+						{Property: "name", Datatype: "varchar(20)"},
+						{Property: "age", Datatype: "numbr"},
+						{Property: "x", Custom: map[string]any{"expression": "now()"}},
+					}},
+					OutgoingMappingConfig: &common.OutgoingMappingConfig{PropertyMappings: []*common.ItemToEntityPropertyMapping{
+						{Property: "age", Datatype: "INTEGER"},
+						{Property: "id", Datatype: "object", IsIdentity: true},
+					}},
+				},
+				{DatasetName: "people-v2"},
+				{DatasetName: "c", SourceConfig: map[string]any{Query: "DELETE FROM t", TableName: "t", QueryParams: []any{map[string]any{}}}},
+				{DatasetName: "d", SourceConfig: map[string]any{QueryParams: []any{"x"}}},
+				{DatasetName: "e", SourceConfig: map[string]any{ClusterBy: []any{"to_date(recorded)", "substr(id, 1, 4)"},
+					LatestClusterBy: "id); DROP TABLE x; --"}},
+				{DatasetName: "a"},
+			},
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, expected := range []string{
+			"dataset a:\n  table_name must be a string, got int\n  latest_table must be a boolean, got string",
+			"dataset b:\n  schema \"my schema\" is not a valid snowflake identifier",
+			"unsupported latest_strategy sometimes",
+			`filter_columns "1=1 or x" is not a valid snowflake identifier`,
+			`incoming property age has unsupported datatype "numbr"`,
+			"incoming property x has a custom expression, but no datatype",
+			`outgoing property age has unsupported datatype "INTEGER"`,
+			`outgoing property id is an identity or reference, and cannot have datatype "object"`,
+			"dataset people-v2:\n  table name derived from dataset name \"people-v2\" is not a valid snowflake identifier",
+			"dataset a is defined more than once",
+			"dataset c:\n  query must be a SELECT statement\n  query and table_name cannot be combined\n" +
+				"  query_params[0] must be a string, number or boolean, got map[string]interface {}",
+			"dataset d:\n  query_params needs a query",
+			"dataset e:\n  latest_cluster_by \"id); DROP TABLE x; --\" must be a column or a function of columns, e.g. to_date(recorded)",
+		} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("expected error to contain %q, got:\n%v", expected, err)
+			}
+		}
+		if strings.Contains(err.Error(), "name has unsupported datatype") {
+			t.Errorf("varchar(20) should be a valid datatype: %v", err)
+		}
+		// previous definitions stay active
+		ds, lerr := subject.Dataset("valid")
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		if len(ds.(*Dataset).sourceConfig) != 0 {
+			t.Fatal("expected configured dataset to remain")
+		}
+		if _, found := subject.(*SnowflakeDataLayer).registry().get("a"); found {
+			t.Fatal("invalid dataset should not be added")
+		}
+	})
+	t.Run("should keep the definition of resolved datasets on update", func(t *testing.T) {
+		setup()
+		if subject.UpdateConfiguration(&common.Config{
+			DatasetDefinitions: []*common.DatasetDefinition{{DatasetName: "test", SourceConfig: map[string]any{"v": 1}}},
+		}) != nil {
+			t.Fatal("failed to add dataset definition")
+		}
+		ds, err := subject.Dataset("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject.UpdateConfiguration(&common.Config{
+			DatasetDefinitions: []*common.DatasetDefinition{{DatasetName: "test", SourceConfig: map[string]any{"v": 2}}},
+		}) != nil {
+			t.Fatal("failed to update dataset definition")
+		}
+		if ds.(*Dataset).sourceConfig["v"] != 1 || ds.(*Dataset).datasetDefinition.SourceConfig["v"] != 1 {
+			t.Fatal("resolved dataset should keep its definition")
+		}
+		updated, _ := subject.Dataset("test")
+		if updated.(*Dataset).sourceConfig["v"] != 2 {
+			t.Fatal("new requests should see the updated definition")
+		}
+	})
+	t.Run("should allow concurrent updates and requests", func(t *testing.T) {
+		// run with -race to detect unsynchronized access
+		conf, metrics, logger := testDeps()
+		conf.NativeSystemConfig[DiscoverTables] = false
+		subject, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					if i == 0 {
+						if err := subject.UpdateConfiguration(&common.Config{
+							DatasetDefinitions: []*common.DatasetDefinition{
+								{DatasetName: "test", SourceConfig: map[string]any{TableName: fmt.Sprintf("t%d", j)}},
+								{DatasetName: fmt.Sprintf("other%d", j%3)},
+							},
+						}); err != nil {
+							t.Error(err)
+						}
+						continue
+					}
+					ds, err := subject.Dataset("test")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					_ = ds.(*Dataset).sourceConfig[TableName]
+					_ = ds.(*Dataset).datasetDefinition.DatasetName
+					_ = subject.DatasetDescriptions()
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
 	t.Run("should fail on missing layer_config", func(t *testing.T) {
 		conf, metrics, logger := testDeps()
 		conf.LayerServiceConfig = nil
@@ -157,6 +289,22 @@ func TestConfig(t *testing.T) {
 			t.Fatalf("unexpected error: %v", err)
 		}
 	})
+	t.Run("should fail on missing service_name", func(t *testing.T) {
+		conf, metrics, logger := testDeps()
+		conf.LayerServiceConfig.ServiceName = ""
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err == nil || err.Error() != "missing required config value service_name" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("should fail on missing port", func(t *testing.T) {
+		conf, metrics, logger := testDeps()
+		conf.LayerServiceConfig.Port = ""
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err == nil || err.Error() != "missing required config value port" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
 	t.Run("with EnvOverrides", func(t *testing.T) {
 		t.Setenv("SNOWFLAKE_DB", "overridden_test")
 		t.Run("should override config with env vars", func(t *testing.T) {
@@ -180,7 +328,7 @@ func TestConfig(t *testing.T) {
 				t.Fatal("dataset is nil")
 
 			}
-			if ds.MetaData()["database"] != "overridden_test" {
+			if ds.(*Dataset).sourceConfig["database"] != "overridden_test" {
 				t.Fatal("source config not updated")
 			}
 		})
@@ -0,0 +1,129 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	gsf "github.com/snowflakedb/gosnowflake"
+)
+
+// selectPattern matches the statements allowed as dataset query
+var selectPattern = regexp.MustCompile(`(?is)^\s*(SELECT|WITH)\s`)
+
+// customQuery returns the SELECT statement of a query dataset and its bound parameters,
+// or an empty statement for table datasets. The source config is validated in UpdateConfiguration.
+func customQuery(datasetDefinition *common.DatasetDefinition) (string, []any) {
+	stmt, _ := datasetDefinition.SourceConfig[Query].(string)
+	params, _ := datasetDefinition.SourceConfig[QueryParams].([]any)
+	return stmt, params
+}
+
+// validateQuery checks the form of a dataset query, snowflake compiles it in explainQueries
+func validateQuery(sc *sourceConfig) error {
+	if sc.query == "" {
+		if len(sc.queryParams) > 0 {
+			return fmt.Errorf("%s needs a %s", QueryParams, Query)
+		}
+		return nil
+	}
+	var errs []error
+	if !selectPattern.MatchString(sc.query) {
+		errs = append(errs, fmt.Errorf("%s must be a SELECT statement", Query))
+	}
+	if sc.tableName != "" {
+		errs = append(errs, fmt.Errorf("%s and %s cannot be combined", Query, TableName))
+	}
+	for i, p := range sc.queryParams {
+		switch p.(type) {
+		case string, float64, int, bool:
+		default:
+			errs = append(errs, fmt.Errorf("%s[%d] must be a string, number or boolean, got %T", QueryParams, i, p))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// explainQueries lets snowflake compile the queries of all query datasets, so that invalid statements,
+// missing tables and parameter mismatches are rejected with the configuration. Other errors, like an
+// unavailable snowflake, are logged and the definitions are kept. Reads report them again.
+func (dl *SnowflakeDataLayer) explainQueries(definitions []*common.DatasetDefinition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var errs []error
+	for _, definition := range definitions {
+		stmt, params := customQuery(definition)
+		if stmt == "" {
+			continue
+		}
+		err := dl.explainQuery(ctx, definition.DatasetName, stmt, params)
+		if err == nil {
+			continue
+		}
+		if !isCompileError(err) {
+			dl.logger.Warn("Failed to compile dataset query, keeping the definition",
+				"dataset", definition.DatasetName, "error", err)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("dataset %s: invalid %s: %w", definition.DatasetName, Query, err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid dataset_definitions:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// explainQuery compiles a dataset query in a layer session, so that it sees the same roles as reads
+func (dl *SnowflakeDataLayer) explainQuery(ctx context.Context, dataset string, stmt string, params []any) error {
+	conn, err := dl.db.newConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := initSession(ctx, conn, newQueryTag(dl.serviceName(), dataset, OperationExplain)); err != nil {
+		return err
+	}
+	return dl.db.explain(ctx, conn, stmt, params)
+}
+
+// isCompileError reports whether err is a snowflake compilation error: a syntax error, a missing object or
+// column, or another error of SQL state class 42, like a wrong number of bound parameters
+func isCompileError(err error) bool {
+	var sfErr *gsf.SnowflakeError
+	if !errors.As(err, &sfErr) {
+		return false
+	}
+	switch sfErr.Number {
+	case sfErrSyntax, sfErrInvalidIdentifier, sfErrObjectNotFound:
+		return true
+	}
+	return strings.HasPrefix(sfErr.SQLState, "42")
+}
+
+// explain compiles a statement without running it
+func (sf *SfDB) explain(ctx context.Context, conn *sql.Conn, stmt string, args []any) error {
+	rows, err := sf.query(ctx, conn, "EXPLAIN USING TEXT "+stmt, args...)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
@@ -17,6 +17,7 @@ package layer
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
@@ -25,12 +26,18 @@ import (
 
 type db interface {
 	newConnection(ctx context.Context) (*sql.Conn, error)
-	putEntities(ctx context.Context, datasetName string, stage string, entities []*egdm.Entity) ([]string, error)
+	putEntities(ctx context.Context, stage string, entities []*egdm.Entity, datasetDefinition *common.DatasetDefinition, lc *loadConfig) ([]string, error)
 	mkStage(ctx context.Context, syncID string, datasetName string, datasetDefinition *common.DatasetDefinition) (string, error)
 	getFsStage(syncId string, datasetDefinition *common.DatasetDefinition) string
 	loadStage(ctx context.Context, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) error
-	loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) error
+	loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition, lc *loadConfig) error
+	mkPipe(ctx context.Context, datasetDefinition *common.DatasetDefinition) (string, string, error)
+	ingestFiles(ctx context.Context, pipe string, files []string, datasetDefinition *common.DatasetDefinition) error
 	createQuery(ctx context.Context, datasetDefinition *common.DatasetDefinition) (query, error)
+	explain(ctx context.Context, conn *sql.Conn, stmt string, args []any) error
+	tableParts(datasetDefinition *common.DatasetDefinition) (string, string, string)
+	discoverTables(ctx context.Context, database string, schemas []string) ([]tableInfo, error)
+	tableStats(ctx context.Context, datasetDefinition *common.DatasetDefinition) (*tableStats, error)
 	close() error
 }
 
@@ -40,11 +47,45 @@ type Dataset struct {
 	datasetDefinition *common.DatasetDefinition
 	sourceConfig      map[string]any
 	name              string
+	state             *loadState
+	// load states of the layer, to look up state on the first write of an implicit dataset
+	states *loadStates
+	// guard rejects writes that buffer entities while the layer is low on memory
+	guard *memoryGuard
+	// admission limits the concurrent writers and readers of the dataset
+	admission *admission
+	// service name of the layer, for query tags
+	service string
+	// batch size and file settings of writes, defaults if nil
+	load *loadConfig
+	// operations denied by layer_mode, allow_read and allow_write
+	access access
+	// request filters of reads, see withFilters
+	filters []filter
+	// after this time a started full sync is no longer reported as in progress
+	fullSyncTimeout time.Duration
 }
 
-// MetaData implements common.Dataset.
-func (ds *Dataset) MetaData() map[string]any {
-	return ds.sourceConfig
+// loadState returns the load state of the dataset. Implicit datasets look theirs up on the first write,
+// so that requests for arbitrary dataset names do not add load states.
+func (ds *Dataset) loadState() *loadState {
+	if ds.state == nil && ds.states != nil {
+		ds.state = ds.states.get(ds.name)
+	}
+	return ds.state
+}
+
+// batchSize is the number of entities per uploaded file
+func (ds *Dataset) batchSize() int64 {
+	return ds.loadSettings().batchSize
+}
+
+// loadSettings returns the load settings of the dataset, or the defaults if it has none
+func (ds *Dataset) loadSettings() *loadConfig {
+	if ds.load == nil {
+		return defaultLoadConfig()
+	}
+	return ds.load
 }
 
 // Name implements common.Dataset.
@@ -52,30 +93,36 @@ func (ds *Dataset) Name() string {
 	return ds.name
 }
 
-func (ds *Dataset) dbCtx(ctx context.Context) (context.Context, func(), error) {
+// dbCtx opens a tagged session for one request. operation is one of the Operation constants.
+func (ds *Dataset) dbCtx(ctx context.Context, operation string) (context.Context, func(), error) {
+	// wait for a free slot before a connection is taken from the pool
+	releaseSlot, err := ds.admission.admit(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 	var cancel context.CancelFunc
 	ctx, cancel = context.WithCancel(ctx)
 	ctx = context.WithValue(ctx, Recorded, time.Now().UnixNano())
 	conn, err := ds.db.newConnection(ctx)
 	if err != nil {
 		defer cancel()
+		releaseSlot()
 		return nil, nil, err
 	}
 
-	_, err = conn.ExecContext(ctx, "ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';")
-	if err != nil {
-		defer cancel()
-		return nil, nil, err
-	}
-	// activate secondary roles
-	_, err = conn.ExecContext(ctx, "USE SECONDARY ROLES ALL;")
+	tag := newQueryTag(ds.service, ds.name, operation)
+	err = initSession(ctx, conn, tag)
 	if err != nil {
 		defer cancel()
+		_ = conn.Close()
+		releaseSlot()
 		return nil, nil, err
 	}
 
 	ctx = context.WithValue(ctx, Connection, conn)
+	ctx = context.WithValue(ctx, QueryTag, tag)
 	return ctx, func() {
+		defer releaseSlot()
 		if ctx.Value(Connection) != nil {
 			cancel()
 			ctxConn := ctx.Value(Connection).(*sql.Conn)
@@ -89,3 +136,18 @@ func (ds *Dataset) dbCtx(ctx context.Context) (context.Context, func(), error) {
 		}
 	}, nil
 }
+
+// initSession prepares a new connection for use by the layer, and tags its statements
+func initSession(ctx context.Context, conn *sql.Conn, tag *queryTag) error {
+	_, err := conn.ExecContext(ctx, "ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';")
+	if err != nil {
+		return err
+	}
+	// activate secondary roles
+	_, err = conn.ExecContext(ctx, "USE SECONDARY ROLES ALL;")
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("ALTER SESSION SET QUERY_TAG = %s;", tag.sql()))
+	return err
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+const defaultDiscoveryTTL = 5 * time.Minute
+
+// tableInfo describes a snowflake table that can be read by the layer
+type tableInfo struct {
+	Database string
+	Schema   string
+	Table    string
+}
+
+type discoveryConfig struct {
+	enabled bool
+	// schemas to discover, grouped by database in order of appearance
+	databases []string
+	schemas   map[string][]string
+	ttl       time.Duration
+}
+
+// discoveryConfigOf reads the table discovery settings from the system config.
+// The configured database and schema are always included.
+func discoveryConfigOf(conf *common.Config) *discoveryConfig {
+	dc := &discoveryConfig{
+		enabled: confBool(conf, DiscoverTables),
+		schemas: map[string][]string{},
+		ttl:     confDuration(conf, DiscoveryTTL),
+	}
+	add := func(database, schema string) {
+		database, schema = strings.ToUpper(database), strings.ToUpper(schema)
+		if _, ok := dc.schemas[database]; !ok {
+			dc.databases = append(dc.databases, database)
+		}
+		for _, s := range dc.schemas[database] {
+			if s == schema {
+				return
+			}
+		}
+		dc.schemas[database] = append(dc.schemas[database], schema)
+	}
+	add(confString(conf, SnowflakeDB), confString(conf, SnowflakeSchema))
+	// entries are validated to have the form database.schema
+	for _, s := range confStrings(conf, DiscoverySchemas) {
+		if database, schema, ok := strings.Cut(s, "."); ok {
+			add(database, schema)
+		}
+	}
+	return dc
+}
+
+// discoveryCache holds the discovered tables until the ttl expires
+type discoveryCache struct {
+	mu      sync.Mutex
+	tables  []tableInfo
+	expires time.Time
+}
+
+// discoveredTables returns the cached tables, and refreshes them from snowflake when the cache is expired.
+// If the refresh fails, the previous result is returned.
+func (dl *SnowflakeDataLayer) discoveredTables(dc *discoveryConfig) []tableInfo {
+	dl.discovery.mu.Lock()
+	defer dl.discovery.mu.Unlock()
+	if time.Now().Before(dl.discovery.expires) {
+		return dl.discovery.tables
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var tables []tableInfo
+	for _, database := range dc.databases {
+		t, err := dl.db.discoverTables(ctx, database, dc.schemas[database])
+		if err != nil {
+			dl.logger.Warn("Failed to discover tables", "database", database, "error", err)
+			return dl.discovery.tables
+		}
+		tables = append(tables, t...)
+	}
+	dl.discovery.tables = tables
+	dl.discovery.expires = time.Now().Add(dc.ttl)
+	return tables
+}
+
+// discoveredDescriptions describes the discovered tables that are not already covered by a configured dataset.
+// Discovered tables are named database.schema.table, so that they can be read with implicit mapping.
+func (dl *SnowflakeDataLayer) discoveredDescriptions() []*common.DatasetDescription {
+	dc := discoveryConfigOf(dl.config)
+	if !dc.enabled {
+		return nil
+	}
+	configured := map[string]bool{}
+	for _, ds := range dl.registry().datasets {
+		dbName, schemaName, table := dl.db.tableParts(ds.datasetDefinition)
+		configured[dbName+"."+schemaName+"."+table] = true
+	}
+
+	var descriptions []*common.DatasetDescription
+	for _, t := range dl.discoveredTables(dc) {
+		name := t.Database + "." + t.Schema + "." + t.Table
+		// tables that cannot be read by name are not listed either
+		if configured[name] || !dl.implicitReadAllowed(name) {
+			continue
+		}
+		descriptions = append(descriptions, &common.DatasetDescription{
+			Name:        name,
+			Description: "snowflake table with ENTITY column",
+			Metadata: map[string]any{
+				Database:  t.Database,
+				Schema:    t.Schema,
+				TableName: t.Table,
+			},
+		})
+	}
+	return descriptions
+}
+
+// discoverTables lists the tables in the given schemas of a database that have an ENTITY column, since implicit
+// reads only select that column. Tables written with column mappings need a dataset definition to be read.
+// Full sync load tables are skipped.
+func (sf *SfDB) discoverTables(ctx context.Context, database string, schemas []string) ([]tableInfo, error) {
+	args := make([]any, len(schemas))
+	for i, s := range schemas {
+		args[i] = s
+	}
+	q := fmt.Sprintf(`
+	SELECT t.TABLE_SCHEMA, t.TABLE_NAME
+	FROM %[1]s.INFORMATION_SCHEMA.TABLES t
+	JOIN %[1]s.INFORMATION_SCHEMA.COLUMNS c ON c.TABLE_SCHEMA = t.TABLE_SCHEMA AND c.TABLE_NAME = t.TABLE_NAME
+	WHERE t.TABLE_SCHEMA IN (%[2]s) AND c.COLUMN_NAME = 'ENTITY'
+	ORDER BY t.TABLE_SCHEMA, t.TABLE_NAME;
+	`, database, strings.TrimSuffix(strings.Repeat("?, ", len(schemas)), ", "))
+	rows, err := sf.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []tableInfo
+	for rows.Next() {
+		t := tableInfo{Database: database}
+		if err := rows.Scan(&t.Schema, &t.Table); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(t.Table, "S_") && strings.Contains(t.Table, "_FSID_") {
+			continue
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
@@ -16,20 +16,37 @@ package layer
 
 import (
 	"context"
+	"errors"
 
 	common "github.com/mimiro-io/common-datalayer"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Entities implements common.Dataset.
 // TODO: should the common library pass in a context? to make it consistent with the other methods?
 // TODO: since param should be called 'from' here? to make it consistent with DH. its not a since token but a paging continuation
 func (ds *Dataset) Entities(from string, limit int) (common.EntityIterator, common.LayerError) {
-	ctx, release, err := ds.dbCtx(context.Background())
+	if lerr := ds.checkRead(); lerr != nil {
+		return nil, lerr
+	}
+	// the span covers the whole request, and ends when the iterator is closed
+	ctx, span := startSpan(context.Background(), "snowflake.read", ds.name, attribute.Int("limit", limit))
+	ctx, release, err := ds.dbCtx(ctx, OperationRead)
 	if err != nil {
+		endSpan(span, err)
 		return nil, common.Err(err, common.LayerErrorInternal)
 	}
 	q, err := ds.db.createQuery(ctx, ds.datasetDefinition)
 	if err != nil {
+		release()
+		endSpan(span, err)
+		return nil, common.Err(err, common.LayerErrorInternal)
+	}
+
+	where, _ := ds.sourceConfig[Where].(string)
+	if _, err := q.withFilters(where, ds.filters); err != nil {
+		release()
+		endSpan(span, err)
 		return nil, common.Err(err, common.LayerErrorInternal)
 	}
 
@@ -39,6 +56,13 @@ func (ds *Dataset) Entities(from string, limit int) (common.EntityIterator, comm
 	if sinceActive {
 		_, err := q.withSince(sinceColumn.(string), from)
 		if err != nil {
+			release()
+			endSpan(span, err)
+			// missing tables and columns are already mapped by the query
+			var lerr common.LayerError
+			if errors.As(err, &lerr) {
+				return nil, lerr
+			}
 			return nil, common.Err(err, common.LayerErrorInternal)
 		}
 	}
@@ -46,9 +70,15 @@ func (ds *Dataset) Entities(from string, limit int) (common.EntityIterator, comm
 	if limit > 0 {
 		_, err := q.withLimit(limit)
 		if err != nil {
+			release()
+			endSpan(span, err)
 			return nil, common.Err(err, common.LayerErrorInternal)
 		}
 	}
 
-	return q.run(ctx, release)
+	it, lerr := q.run(ctx, release)
+	if lerr != nil {
+		endSpan(span, lerr)
+	}
+	return it, lerr
 }
@@ -15,6 +15,7 @@
 package layer
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"io"
@@ -32,18 +33,37 @@ func NewTmpFileWriter(dataset string) (*os.File, func(), error) {
 	return file, finally, nil
 }
 
-func WriteAsGzippedNDJson(file io.Writer, entities []*egdm.Entity, _ string) error {
-	zipWriter := gzip.NewWriter(file)
-	j := newWriter(zipWriter)
+// WriteAsGzippedNDJson writes entities to file, as long as the uncompressed size stays within maxBytes.
+// It returns the number of written entities, which is at least one, so a file only exceeds maxBytes when
+// its first entity does. maxBytes 0 means no limit.
+func WriteAsGzippedNDJson(file io.Writer, entities []*egdm.Entity, level int, maxBytes int64) (int, error) {
+	zipWriter, err := gzip.NewWriterLevel(file, level)
+	if err != nil {
+		return 0, err
+	}
+	// each entity is encoded on its own first, so that its size is known before it is written
+	var line bytes.Buffer
+	j := newWriter(&line)
+	var size int64
+	written := 0
 	for _, entity := range entities {
+		line.Reset()
 		err := j.Add(entity)
 		if err != nil {
-			return err
+			return written, err
+		}
+		if maxBytes > 0 && written > 0 && size+int64(line.Len()) > maxBytes {
+			break
+		}
+		if _, err := zipWriter.Write(line.Bytes()); err != nil {
+			return written, err
 		}
+		size += int64(line.Len())
+		written++
 	}
 
 	// flush and close
-	return zipWriter.Close()
+	return written, zipWriter.Close()
 }
 
 type Writer struct {
@@ -0,0 +1,90 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// filter restricts a read to rows where column has one of the values
+type filter struct {
+	column string
+	values []string
+}
+
+// withFilters returns a copy of the dataset that reads only the rows matching the request filters.
+//
+// common-datalayer passes only from and limit to Entities, so filters are part of the dataset name,
+// in url query form: people?country=NO&status=active,pending. A comma in a value is escaped with a
+// backslash, as in status=on\,hold. Only columns listed in filter_columns of the dataset can be filtered on.
+func (ds *Dataset) withFilters(rawQuery string) (*Dataset, common.LayerError) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, common.Errorf(common.LayerErrorBadParameter, "invalid filters for dataset %s: %w", ds.name, err)
+	}
+	allowed := map[string]string{}
+	columns, _ := stringList(ds.sourceConfig[FilterColumns], FilterColumns)
+	for _, c := range columns {
+		allowed[strings.ToUpper(c)] = c
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var filters []filter
+	for _, k := range keys {
+		column, ok := allowed[strings.ToUpper(k)]
+		if !ok {
+			return nil, common.Errorf(common.LayerErrorBadParameter, "column %s is not a filter column of dataset %s", k, ds.name)
+		}
+		f := filter{column: column}
+		for _, v := range values[k] {
+			f.values = append(f.values, splitValues(v)...)
+		}
+		filters = append(filters, f)
+	}
+	filtered := *ds
+	filtered.filters = filters
+	return &filtered, nil
+}
+
+// splitValues splits a filter value on commas. A backslash makes the next character literal,
+// so that values can contain commas and backslashes.
+func splitValues(v string) []string {
+	var values []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range v {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			values = append(values, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(values, current.String())
+}
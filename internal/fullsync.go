@@ -17,14 +17,26 @@ package layer
 import (
 	"context"
 	"strings"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (ds *Dataset) FullSync(ctx context.Context, batchInfo common.BatchInfo) (common.DatasetWriter, common.LayerError) {
-	ctx, release, err := ds.dbCtx(ctx)
+	if lerr := ds.checkWrite(); lerr != nil {
+		return nil, lerr
+	}
+	// each batch of a full sync is traced on its own, and ends when the writer is closed
+	ctx, span := startSpan(ctx, "snowflake.fullsync", ds.name,
+		attribute.String("sync_id", batchInfo.SyncId),
+		attribute.Bool("start_batch", batchInfo.IsStartBatch),
+		attribute.Bool("last_batch", batchInfo.IsLastBatch))
+	ctx, release, err := ds.dbCtx(ctx, OperationFullSync)
 	if err != nil {
+		endSpan(span, err)
 		return nil, common.Err(err, common.LayerErrorInternal)
 	}
 	fsID := batchInfo.SyncId
@@ -38,21 +50,23 @@ func (ds *Dataset) FullSync(ctx context.Context, batchInfo common.BatchInfo) (co
 		stage, err2 = ds.db.mkStage(ctx, fsID, ds.name, ds.datasetDefinition)
 		if err2 != nil {
 			ds.logger.Error("Failed to create stage", "error", err2, "stage", stage)
+			release()
+			endSpan(span, err2)
 			return nil, common.Err(err2, common.LayerErrorInternal)
 		}
 		ds.logger.Info("Created stage", "stage", stage)
+		ds.loadState().fullSyncStart(fsID, time.Now())
 	} else {
 		// getStage
 		stage = ds.db.getFsStage(fsID, ds.datasetDefinition)
 	}
 
-	// TODO: make configurable in navtive system config?
-	var batchSize int64 = 50000
 	writer := &datasetWriter{
 		dataset:   ds,
 		ctx:       ctx,
+		span:      span,
 		batchInfo: batchInfo,
-		batchSize: batchSize,
+		batchSize: ds.batchSize(),
 		stage:     stage,
 		release:   release,
 	}
@@ -63,21 +77,24 @@ func (ds *Dataset) FullSync(ctx context.Context, batchInfo common.BatchInfo) (co
 
 type datasetWriter struct {
 	ctx       context.Context
+	span      trace.Span
 	dataset   *Dataset
 	release   func()
 	stage     string
 	batchInfo common.BatchInfo
 	entities  []*egdm.Entity
 	read      int64
+	written   int64
 	batchSize int64
 }
 
 // Close implements common_datalayer.DatasetWriter.
-func (w *datasetWriter) Close() common.LayerError {
+func (w *datasetWriter) Close() (lerr common.LayerError) {
 	defer w.release()
+	defer func() { w.endSpan(lerr) }()
 	// empty the buffer
 	if w.read > 0 {
-		_, err := w.dataset.db.putEntities(w.ctx, w.dataset.name, w.stage, w.entities)
+		_, err := w.dataset.db.putEntities(w.ctx, w.stage, w.entities, w.dataset.datasetDefinition, w.dataset.loadSettings())
 		if err != nil {
 			return common.Err(err, common.LayerErrorInternal)
 		}
@@ -89,6 +106,7 @@ func (w *datasetWriter) Close() common.LayerError {
 		if err != nil {
 			return common.Err(err, common.LayerErrorInternal)
 		}
+		w.dataset.loadState().fullSyncLoaded(time.Now())
 
 	}
 	return nil
@@ -98,9 +116,20 @@ func (w *datasetWriter) Close() common.LayerError {
 func (w *datasetWriter) Write(entity *egdm.Entity) common.LayerError {
 	w.entities = append(w.entities, entity)
 	w.read++
+	w.written++
+	if w.read%memoryCheckInterval == 0 {
+		if err := w.dataset.guard.assert("write", w.dataset.name); err != nil {
+			// the web service does not close writers after a failed write
+			w.release()
+			w.release = func() {}
+			w.endSpan(err)
+			return err
+		}
+	}
 	if w.read == w.batchSize {
-		_, err := w.dataset.db.putEntities(w.ctx, w.dataset.name, w.stage, w.entities)
+		_, err := w.dataset.db.putEntities(w.ctx, w.stage, w.entities, w.dataset.datasetDefinition, w.dataset.loadSettings())
 		if err != nil {
+			w.endSpan(err)
 			return common.Err(err, common.LayerErrorInternal)
 		}
 		w.read = 0
@@ -108,3 +137,12 @@ func (w *datasetWriter) Write(entity *egdm.Entity) common.LayerError {
 	}
 	return nil
 }
+
+// endSpan ends the request span with the number of written entities
+func (w *datasetWriter) endSpan(err error) {
+	if w.span == nil {
+		return
+	}
+	w.span.SetAttributes(attribute.Int64("entities", w.written))
+	endSpan(w.span, err)
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// the common-datalayer web service cannot be extended with routes,
+// so the layer serves its own health endpoints on a separate port.
+func (dl *SnowflakeDataLayer) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/preflight", dl.handlePreflight)
+	mux.HandleFunc("/health/live", dl.handleLive)
+	mux.HandleFunc("/health/ready", dl.handleReady)
+	mux.HandleFunc("GET /datasets/{dataset}/metadata", dl.handleMetaData)
+	return mux
+}
+
+func (dl *SnowflakeDataLayer) startHealthServer(port string) {
+	dl.healthServer = &http.Server{
+		Addr:              ":" + port,
+		Handler:           dl.healthHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		dl.logger.Info("Starting health server", "port", port)
+		if err := dl.healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			dl.logger.Error("Health server failed", "error", err)
+		}
+	}()
+}
+
+func (dl *SnowflakeDataLayer) stopHealthServer(ctx context.Context) error {
+	if dl.healthServer == nil {
+		return nil
+	}
+	return dl.healthServer.Shutdown(ctx)
+}
+
+// handlePreflight returns the last preflight report on GET, and runs the checks again on POST.
+// The status is 503 when a probe failed.
+func (dl *SnowflakeDataLayer) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	var report *preflightReport
+	switch r.Method {
+	case http.MethodGet:
+		report = dl.preflightState.last()
+	case http.MethodPost:
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+		defer cancel()
+		report = dl.preflight(ctx)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if report == nil {
+		http.Error(w, "no preflight checks have run, POST to run them", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// handleLive reports that the process serves requests. It does not depend on snowflake,
+// so that an unavailable snowflake makes the layer unready, but does not restart it.
+func (dl *SnowflakeDataLayer) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"live": true})
+}
+
+// handleReady returns the readiness report, with status 503 when the layer should not receive requests
+func (dl *SnowflakeDataLayer) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := dl.readiness(time.Now())
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// handleMetaData returns the metadata of a configured dataset, including the table facts that
+// the dataset list of the web service leaves out
+func (dl *SnowflakeDataLayer) handleMetaData(w http.ResponseWriter, r *http.Request) {
+	ds, found := dl.registry().get(r.PathValue("dataset"))
+	if !found {
+		http.Error(w, "dataset not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, ds.MetaData())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
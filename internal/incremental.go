@@ -16,72 +16,130 @@ package layer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Incremental implements common.Dataset.
 func (ds *Dataset) Incremental(ctx context.Context) (common.DatasetWriter, common.LayerError) {
-	ctx, release, err := ds.dbCtx(ctx)
+	if lerr := ds.checkWrite(); lerr != nil {
+		return nil, lerr
+	}
+	// the span covers the whole request, and ends when the writer is closed
+	ctx, span := startSpan(ctx, "snowflake.incremental", ds.name)
+	ctx, release, err := ds.dbCtx(ctx, OperationIncremental)
 	if err != nil {
+		endSpan(span, err)
 		return nil, common.Err(err, common.LayerErrorInternal)
 	}
-	stage, err2 := ds.db.mkStage(ctx, "", ds.name, ds.datasetDefinition)
-	if err2 != nil {
-		return nil, common.Err(err2, common.LayerErrorInternal)
-	}
-
-	// TODO: make configurable in navtive system config?
-	var batchSize int64 = 50000
-	return &batchWriter{
+	writer := &batchWriter{
 		ctx:       ctx,
+		span:      span,
 		dataset:   ds,
 		release:   release,
-		stage:     stage,
-		batchSize: batchSize,
-	}, nil
+		batchSize: ds.batchSize(),
+	}
+	var err2 error
+	// in pipe mode, files are only uploaded to the pipe stage and snowflake ingests them asynchronously
+	if mode, _ := ds.sourceConfig[IngestMode].(string); mode == IngestModePipe {
+		writer.pipe, writer.stage, err2 = ds.db.mkPipe(ctx, ds.datasetDefinition)
+	} else {
+		writer.stage, err2 = ds.db.mkStage(ctx, "", ds.name, ds.datasetDefinition)
+	}
+	if err2 != nil {
+		release()
+		endSpan(span, err2)
+		return nil, common.Err(err2, common.LayerErrorInternal)
+	}
+	// batches are identified by a hash of their content. common-datalayer does not pass request headers
+	// to the layer, so clients cannot provide their own key
+	if idempotent, ok := ds.sourceConfig[IdempotentBatches].(bool); ok && idempotent {
+		writer.batchHash = sha256.New()
+	}
+	return writer, nil
 }
 
 type batchWriter struct {
 	ctx       context.Context
+	span      trace.Span
 	dataset   *Dataset
 	release   func()
 	stage     string
+	pipe      string
 	entities  []*egdm.Entity
 	files     []string
 	read      int64
+	written   int64
 	batchSize int64
+	batchHash hash.Hash
 }
 
 // Close implements common_datalayer.DatasetWriter.
-func (w *batchWriter) Close() common.LayerError {
+func (w *batchWriter) Close() (lerr common.LayerError) {
 	defer w.release()
+	defer func() { w.endSpan(lerr) }()
 	if w.read > 0 {
-		newFiles, err := w.dataset.db.putEntities(w.ctx, w.dataset.name, w.stage, w.entities)
+		newFiles, err := w.dataset.db.putEntities(w.ctx, w.stage, w.entities, w.dataset.datasetDefinition, w.dataset.loadSettings())
 		if err != nil {
 			return common.Err(err, common.LayerErrorInternal)
 		}
 		w.files = append(w.files, newFiles...)
 	}
 
+	if len(w.files) > 0 && w.pipe != "" {
+		if err := w.dataset.db.ingestFiles(w.ctx, w.pipe, w.files, w.dataset.datasetDefinition); err != nil {
+			return common.Err(err, common.LayerErrorInternal)
+		}
+		w.dataset.loadState().incrementalLoaded(time.Now())
+		return nil
+	}
+
 	if len(w.files) > 0 {
-		err := w.dataset.db.loadFilesInStage(w.ctx, w.files, w.stage, w.ctx.Value(Recorded).(int64), w.dataset.datasetDefinition)
+		ctx := w.ctx
+		if w.batchHash != nil {
+			ctx = context.WithValue(ctx, BatchKey, hex.EncodeToString(w.batchHash.Sum(nil)))
+		}
+		err := w.dataset.db.loadFilesInStage(ctx, w.files, w.stage, w.ctx.Value(Recorded).(int64), w.dataset.datasetDefinition, w.dataset.loadSettings())
 		if err != nil {
 			return common.Err(err, common.LayerErrorInternal)
 		}
+		w.dataset.loadState().incrementalLoaded(time.Now())
 	}
 	return nil
 }
 
 // Write implements common_datalayer.DatasetWriter.
 func (w *batchWriter) Write(entity *egdm.Entity) common.LayerError {
+	if w.batchHash != nil {
+		if err := json.NewEncoder(w.batchHash).Encode(entity); err != nil {
+			return common.Err(err, common.LayerErrorInternal)
+		}
+	}
 	w.entities = append(w.entities, entity)
 	w.read++
+	w.written++
+	if w.read%memoryCheckInterval == 0 {
+		if err := w.dataset.guard.assert("write", w.dataset.name); err != nil {
+			// the web service does not close writers after a failed write
+			w.release()
+			w.release = func() {}
+			w.endSpan(err)
+			return err
+		}
+	}
 	if w.read == w.batchSize {
 
-		newFiles, err := w.dataset.db.putEntities(w.ctx, w.dataset.name, w.stage, w.entities)
+		newFiles, err := w.dataset.db.putEntities(w.ctx, w.stage, w.entities, w.dataset.datasetDefinition, w.dataset.loadSettings())
 		if err != nil {
+			w.endSpan(err)
 			return common.Err(err, common.LayerErrorInternal)
 		}
 		w.files = append(w.files, newFiles...)
@@ -91,3 +149,12 @@ func (w *batchWriter) Write(entity *egdm.Entity) common.LayerError {
 	}
 	return nil
 }
+
+// endSpan ends the request span with the number of written entities
+func (w *batchWriter) endSpan(err error) {
+	if w.span == nil {
+		return
+	}
+	w.span.SetAttributes(attribute.Int64("entities", w.written), attribute.Int("files", len(w.files)))
+	endSpan(w.span, err)
+}
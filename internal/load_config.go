@@ -0,0 +1,93 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"compress/gzip"
+	"errors"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+var (
+	defaultBatchSize int64 = 50000
+	// snowflake accepts at most 1000 files in the FILES option of COPY INTO
+	defaultMaxFilesPerCopy = 1000
+)
+
+// loadConfig controls how written entities are split into files, and how the files are loaded
+type loadConfig struct {
+	// entities per file
+	batchSize int64
+	// uncompressed bytes per file, 0 means no limit
+	maxFileBytes int64
+	gzipLevel    int
+	// files per COPY INTO statement of incremental loads
+	maxFilesPerCopy int
+}
+
+// loadConfigOf reads the load settings from the system config, overridden by the dataset source config.
+// Source config values are checked like the system config options, and all problems are reported in one error.
+func loadConfigOf(conf *common.Config, source map[string]any) (*loadConfig, error) {
+	lc := &loadConfig{
+		batchSize:       int64(confInt(conf, BatchSize)),
+		maxFileBytes:    int64(confInt(conf, MaxFileBytes)),
+		gzipLevel:       confInt(conf, GzipLevel),
+		maxFilesPerCopy: confInt(conf, MaxFilesPerCopy),
+	}
+	var errs []error
+	override := func(key string, dst func(int)) {
+		v, ok := source[key]
+		if !ok {
+			return
+		}
+		n, err := settingFor(key).check(v)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		dst(n.(int))
+	}
+	override(BatchSize, func(n int) { lc.batchSize = int64(n) })
+	override(MaxFileBytes, func(n int) { lc.maxFileBytes = int64(n) })
+	override(GzipLevel, func(n int) { lc.gzipLevel = n })
+	override(MaxFilesPerCopy, func(n int) { lc.maxFilesPerCopy = n })
+	return lc, errors.Join(errs...)
+}
+
+// loadConfigFor returns the load settings of a dataset, validated in UpdateConfiguration
+func (dl *SnowflakeDataLayer) loadConfigFor(sourceConfig map[string]any) *loadConfig {
+	lc, _ := loadConfigOf(dl.config, sourceConfig)
+	return lc
+}
+
+// defaultLoadConfig returns the load settings of the system config defaults
+func defaultLoadConfig() *loadConfig {
+	return &loadConfig{
+		batchSize:       defaultBatchSize,
+		gzipLevel:       gzip.DefaultCompression,
+		maxFilesPerCopy: defaultMaxFilesPerCopy,
+	}
+}
+
+// chunks splits files into slices of at most size files
+func chunks(files []string, size int) [][]string {
+	var res [][]string
+	for len(files) > size {
+		res = append(res, files[:size])
+		files = files[size:]
+	}
+	return append(res, files)
+}
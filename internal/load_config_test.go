@@ -0,0 +1,146 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("should use defaults", func(t *testing.T) {
+		lc, err := loadConfigOf(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lc.batchSize != 50000 || lc.maxFileBytes != 0 || lc.gzipLevel != gzip.DefaultCompression || lc.maxFilesPerCopy != 1000 {
+			t.Fatalf("unexpected defaults %+v", lc)
+		}
+	})
+	t.Run("should override system config with source config", func(t *testing.T) {
+		lc, err := loadConfigOf(
+			&common.Config{NativeSystemConfig: map[string]any{BatchSize: float64(1000), GzipLevel: 9, MaxFileBytes: float64(1 << 20)}},
+			map[string]any{BatchSize: float64(10), MaxFilesPerCopy: float64(5)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lc.batchSize != 10 || lc.maxFileBytes != 1<<20 || lc.gzipLevel != 9 || lc.maxFilesPerCopy != 5 {
+			t.Fatalf("unexpected config %+v", lc)
+		}
+	})
+	t.Run("should report all invalid values", func(t *testing.T) {
+		_, err := loadConfigOf(nil,
+			map[string]any{BatchSize: 0, GzipLevel: 10, MaxFileBytes: "1MB", MaxFilesPerCopy: 1001})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, key := range []string{BatchSize, GzipLevel, MaxFileBytes, MaxFilesPerCopy} {
+			if !strings.Contains(err.Error(), key+" must be an integer") {
+				t.Fatalf("expected %s in error, got %v", key, err)
+			}
+		}
+	})
+	t.Run("should reject invalid settings in system and dataset config", func(t *testing.T) {
+		conf, _, _ := testDeps()
+		conf.NativeSystemConfig[GzipLevel] = 12
+		if err := validateConfig(conf); err == nil {
+			t.Fatal("expected invalid gzip_level to be rejected")
+		}
+		conf, _, _ = testDeps()
+		definitions := []*common.DatasetDefinition{{
+			DatasetName:  "people",
+			SourceConfig: map[string]any{TableName: "people", BatchSize: -1},
+		}}
+		if err := validateDatasetDefinitions(conf, definitions); err == nil {
+			t.Fatal("expected invalid batch_size to be rejected")
+		}
+	})
+	t.Run("should read settings from the environment", func(t *testing.T) {
+		t.Setenv("BATCH_SIZE", "100")
+		t.Setenv("GZIP_LEVEL", "1")
+		conf, _, _ := testDeps()
+		if err := EnvOverrides(conf); err != nil {
+			t.Fatal(err)
+		}
+		lc, err := loadConfigOf(conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lc.batchSize != 100 || lc.gzipLevel != 1 {
+			t.Fatalf("unexpected config %+v", lc)
+		}
+		t.Setenv("MAX_FILES_PER_COPY", "many")
+		if err := EnvOverrides(conf); err == nil {
+			t.Fatal("expected invalid MAX_FILES_PER_COPY to be rejected")
+		}
+	})
+	t.Run("should stop writing a file at max bytes", func(t *testing.T) {
+		var entities []*egdm.Entity
+		for i := 0; i < 10; i++ {
+			entities = append(entities, &egdm.Entity{ID: fmt.Sprintf("http://example.com/%d", i)})
+		}
+		var buf bytes.Buffer
+		// each entity is larger than 10 bytes, so every file holds one entity
+		n, err := WriteAsGzippedNDJson(&buf, entities, gzip.BestSpeed, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("expected 1 entity in file, got %d", n)
+		}
+		// every entity line has 55 bytes, so 170 bytes hold 3 entities
+		buf.Reset()
+		n, err = WriteAsGzippedNDJson(&buf, entities, gzip.BestSpeed, 170)
+		if err != nil || n != 3 {
+			t.Fatalf("expected 3 entities in file, got %d, %v", n, err)
+		}
+		r, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := io.ReadAll(r); len(content) > 170 {
+			t.Fatalf("expected at most 170 uncompressed bytes, got %d", len(content))
+		}
+		buf.Reset()
+		n, err = WriteAsGzippedNDJson(&buf, entities, gzip.BestSpeed, 0)
+		if err != nil || n != 10 {
+			t.Fatalf("expected all entities without limit, got %d, %v", n, err)
+		}
+		r, err = gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(r)
+		if lines := strings.Count(string(content), "\n"); lines != 10 {
+			t.Fatalf("expected 10 lines, got %d", lines)
+		}
+	})
+	t.Run("should split files into chunks", func(t *testing.T) {
+		res := chunks([]string{"a", "b", "c", "d", "e"}, 2)
+		if fmt.Sprint(res) != "[[a b] [c d] [e]]" {
+			t.Fatalf("unexpected chunks %v", res)
+		}
+		if res := chunks([]string{"a"}, 1000); len(res) != 1 {
+			t.Fatalf("unexpected chunks %v", res)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"sync"
+	"time"
+)
+
+// loadState tracks the loads of a dataset in this process.
+// A nil loadState ignores all updates.
+type loadState struct {
+	mu              sync.Mutex
+	lastIncremental time.Time
+	lastFullSync    time.Time
+	fullSyncID      string
+	fullSyncStarted time.Time // zero if no full sync is in progress
+}
+
+// loadStates holds the load state of every dataset, keyed by dataset name.
+// It outlives configuration updates, so that the state of a dataset is kept when its definition changes.
+type loadStates struct {
+	m sync.Map
+}
+
+func (ls *loadStates) get(dataset string) *loadState {
+	s, _ := ls.m.LoadOrStore(dataset, &loadState{})
+	return s.(*loadState)
+}
+
+func (s *loadState) incrementalLoaded(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastIncremental = t
+}
+
+func (s *loadState) fullSyncStart(syncID string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fullSyncID = syncID
+	s.fullSyncStarted = t
+}
+
+func (s *loadState) fullSyncLoaded(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFullSync = t
+	s.fullSyncID = ""
+	s.fullSyncStarted = time.Time{}
+}
+
+// loadSnapshot is a copy of a loadState that can be read without locking
+type loadSnapshot struct {
+	lastIncremental time.Time
+	lastFullSync    time.Time
+	fullSyncID      string
+	fullSyncStarted time.Time
+}
+
+func (s *loadState) snapshot() loadSnapshot {
+	if s == nil {
+		return loadSnapshot{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return loadSnapshot{
+		lastIncremental: s.lastIncremental,
+		lastFullSync:    s.lastFullSync,
+		fullSyncID:      s.fullSyncID,
+		fullSyncStarted: s.fullSyncStarted,
+	}
+}
+
+// fullSyncInProgress reports whether a full sync has started and has not run longer than timeout.
+// A full sync that runs longer is considered abandoned, see fullSyncStuck.
+func (s loadSnapshot) fullSyncInProgress(now time.Time, timeout time.Duration) bool {
+	return !s.fullSyncStarted.IsZero() && now.Sub(s.fullSyncStarted) <= timeout
+}
+
+// fullSyncStuck reports whether a full sync has run longer than timeout. It is reported until a later
+// incremental load succeeds, or for at most another timeout, so that a layer that is taken out of rotation
+// because of the stuck sync becomes ready again.
+func (s loadSnapshot) fullSyncStuck(now time.Time, timeout time.Duration) bool {
+	if s.fullSyncStarted.IsZero() {
+		return false
+	}
+	expired := s.fullSyncStarted.Add(timeout)
+	return now.After(expired) && !now.After(expired.Add(timeout)) && !s.lastIncremental.After(expired)
+}
@@ -17,96 +17,183 @@ package layer
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type SnowflakeDataLayer struct {
-	datasets map[string]*Dataset
-	logger   common.Logger
-	metrics  common.Metrics
-	config   *common.Config
-	db       db
+	// configured datasets, replaced as a whole on configuration updates
+	datasets   atomic.Pointer[datasetRegistry]
+	updateLock sync.Mutex
+	logger     common.Logger
+	metrics    common.Metrics
+	config     *common.Config
+	db         db
+	// tables found in snowflake, listed in DatasetDescriptions
+	discovery discoveryCache
+	// load state of the datasets, kept across configuration updates
+	loadStates     loadStates
+	preflightState preflightState
+	healthServer   *http.Server
+	// result of the periodic snowflake check, reported by the readiness endpoint
+	connectivity connectivityState
+	// limits the concurrent writers and readers, kept across configuration updates
+	admission admissionControl
+	// set when a tracing exporter is configured, flushed on Stop
+	tracerProvider *sdktrace.TracerProvider
+}
+
+func (dl *SnowflakeDataLayer) serviceName() string {
+	if dl.config.LayerServiceConfig == nil {
+		return ""
+	}
+	return dl.config.LayerServiceConfig.ServiceName
 }
 
 // Dataset implements common_datalayer.DataLayerService.
 func (dl *SnowflakeDataLayer) Dataset(dataset string) (common.Dataset, common.LayerError) {
+	// request filters are passed as query in the dataset name, see Dataset.withFilters. Only from and limit
+	// of the request url query reach the layer, so an unencoded filter cannot be detected here
+	dataset, rawFilters, filtered := strings.Cut(dataset, "?")
 	// before we do anything, check memory
-	memErr := dl.assertMemory()
+	memErr := dl.assertMemory(dataset)
 	if memErr != nil {
 		return nil, memErr
 	}
 	// try explicit mappings first
-	ds, found := dl.datasets[dataset]
+	ds, found := dl.registry().get(dataset)
 	if found {
+		if filtered {
+			return ds.withFilters(rawFilters)
+		}
 		return ds, nil
 	}
+	if filtered {
+		return nil, common.Errorf(common.LayerErrorBadParameter, "dataset %s %w, filters need a dataset definition", dataset, ErrNotFound)
+	}
 
-	// construct implicit mapping if not found
-	dl.logger.Debug("Failed to get mapping for dataset " + dataset + ". Trying implicit mapping.")
-	ds = &Dataset{name: dataset, db: dl.db, logger: dl.logger}
+	// construct implicit mapping if not found. In read mode, we expect the dataset name to contain db and schema
+	// in the form db.schema.table
+	readMode := strings.Count(dataset, ".") == 2
+	mapping, err := implicitMapping(dataset)
+	if !readMode {
+		if !dl.implicitWrites() {
+			return nil, common.Errorf(common.LayerErrorBadParameter, "dataset %s %w, %w", dataset, ErrNotFound, err)
+		}
+		// in write mode. we only allow writing to the configured db and schema, so the name is just the table name
+		impWriteName := strings.ReplaceAll(dataset, ".", "_")
+		impWriteName = fmt.Sprintf("%s.%s.%s", confString(dl.config, SnowflakeDB), confString(dl.config, SnowflakeSchema), impWriteName)
+		mapping, err = implicitMapping(impWriteName)
+		if err != nil {
+			// return error if implicit mapping cannot be constructed
+			return nil, common.Errorf(common.LayerErrorBadParameter, "dataset %s not found and cannot infer implicit target table from name, %w", dataset, err)
+		}
+	}
 
-	// in read mode, we expect the dataset name to contain db and schema in the form db.schema.table
-	readMapping, err := implicitMapping(dataset)
-	if err == nil {
-		ds.sourceConfig = readMapping.SourceConfig
-		ds.datasetDefinition = readMapping
-		dl.logger.Debug(fmt.Sprintf("infered implicit target table[r]: %+v", ds.sourceConfig))
-		return ds, nil
+	// implicit reads are restricted by implicit_read_allow and implicit_read_deny, on the resolved table name.
+	// Denied tables are reported like unknown datasets, so that callers cannot probe which tables exist.
+	// Write mode names always resolve to a table in the configured schema, so they stay writable and only
+	// their reads are denied
+	readAllowed := err == nil && dl.implicitReadAllowed(mapping.DatasetName)
+	if readMode && !readAllowed {
+		return nil, common.Errorf(common.LayerErrorBadParameter, "dataset %s %w", dataset, ErrNotFound)
 	}
 
-	// in write mode. we only allow writing to the configured db and schema, so the name is just the table name
-	// implicitWriteName is used to construct the full name in write mode
-	impWriteName := dataset
-	impWriteName = strings.ReplaceAll(dataset, ".", "_")
-	impWriteName = fmt.Sprintf("%s.%s.%s", dl.config.NativeSystemConfig[SnowflakeDB], dl.config.NativeSystemConfig[SnowflakeSchema], impWriteName)
-	writeMapping, err := implicitMapping(impWriteName)
-	if err == nil {
-		ds.sourceConfig = writeMapping.SourceConfig
-		ds.datasetDefinition = writeMapping
-		dl.logger.Debug(fmt.Sprintf("infered implicit target table[w]: %+v", ds.sourceConfig))
-		return ds, nil
+	dl.logger.Debug("Failed to get mapping for dataset " + dataset + ". Using implicit mapping.")
+	ds = &Dataset{
+		name:              dataset,
+		db:                dl.db,
+		logger:            dl.logger,
+		states:            &dl.loadStates,
+		guard:             dl.memoryGuard(),
+		admission:         dl.implicitAdmission(dataset),
+		service:           dl.serviceName(),
+		load:              dl.loadConfigFor(nil),
+		access:            dl.accessFor(nil),
+		fullSyncTimeout:   confDuration(dl.config, FullSyncTimeout),
+		sourceConfig:      mapping.SourceConfig,
+		datasetDefinition: mapping,
 	}
-	// return error if implicit mapping cannot be constructed
-	return nil, common.Errorf(common.LayerErrorBadParameter, "dataset %s not found and cannot infer implicit target table from name, %w", dataset, err)
+	ds.access.readDenied = ds.access.readDenied || !readAllowed
+	dl.logger.Debug(fmt.Sprintf("infered implicit target table: %+v", ds.sourceConfig))
+	return ds, nil
 }
 
 // DatasetDescriptions implements common_datalayer.DataLayerService.
 func (dl *SnowflakeDataLayer) DatasetDescriptions() []*common.DatasetDescription {
 	var datasetDescriptions []*common.DatasetDescription
-	for key := range dl.datasets {
-		datasetDescriptions = append(datasetDescriptions, &common.DatasetDescription{Name: key})
+	reg := dl.registry()
+	for _, key := range reg.names() {
+		ds, _ := reg.get(key)
+		datasetDescriptions = append(datasetDescriptions, &common.DatasetDescription{
+			Name:     key,
+			Metadata: ds.loadMetaData(time.Now()),
+		})
 	}
-	return datasetDescriptions
+	return append(datasetDescriptions, dl.discoveredDescriptions()...)
 }
 
 // Stop implements common_datalayer.DataLayerService.
 func (dl *SnowflakeDataLayer) Stop(ctx context.Context) error {
+	if err := dl.stopHealthServer(ctx); err != nil {
+		dl.logger.Warn("Failed to stop health server", "error", err)
+	}
+	dl.stopConnectivityChecks()
+	if err := dl.stopTracing(ctx); err != nil {
+		dl.logger.Warn("Failed to flush traces", "error", err)
+	}
 	return dl.db.close()
 }
 
 func NewSnowflakeDataLayer(conf *common.Config, logger common.Logger, metrics common.Metrics) (common.DataLayerService, error) {
+	return newSnowflakeDataLayer(conf, logger, metrics, FileSecretProvider{})
+}
+
+// NewSnowflakeDataLayerWithSecrets returns a layer constructor for common.NewServiceRunner
+// that resolves snowflake_private_key_secret with the given secret provider
+func NewSnowflakeDataLayerWithSecrets(secrets SecretProvider) func(*common.Config, common.Logger, common.Metrics) (common.DataLayerService, error) {
+	return func(conf *common.Config, logger common.Logger, metrics common.Metrics) (common.DataLayerService, error) {
+		return newSnowflakeDataLayer(conf, logger, metrics, secrets)
+	}
+}
+
+func newSnowflakeDataLayer(conf *common.Config, logger common.Logger, metrics common.Metrics, secrets SecretProvider) (common.DataLayerService, error) {
 	err := validateConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	sfdb, err := newSfDB(conf, logger, metrics)
+	sfdb, err := newSfDB(conf, logger, metrics, secrets)
 	if err != nil {
 		return nil, err
 	}
 
 	l := &SnowflakeDataLayer{
-		datasets: map[string]*Dataset{},
-		logger:   logger,
-		metrics:  metrics,
-		config:   conf,
-		db:       sfdb,
+		logger:  logger,
+		metrics: metrics,
+		config:  conf,
+		db:      sfdb,
+	}
+	if err = l.startTracing(); err != nil {
+		return nil, err
 	}
 	err = l.UpdateConfiguration(conf)
 	if err != nil {
 		return nil, err
 	}
+	err = l.startupPreflight()
+	if err != nil {
+		return nil, err
+	}
+	if port := confString(conf, HealthPort); port != "" {
+		l.startConnectivityChecks(readinessConfigOf(conf).interval)
+		l.startHealthServer(port)
+	}
 	return l, nil
 }
@@ -17,11 +17,14 @@ package layer
 import (
 	"compress/gzip"
 	"context"
-	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -30,6 +33,8 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	common_datalayer "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	gsf "github.com/snowflakedb/gosnowflake"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func TestWebServer(t *testing.T) {
@@ -70,11 +75,10 @@ func TestWebServer(t *testing.T) {
 			mock = tDB.(*testDB).mock
 
 			l := &SnowflakeDataLayer{
-				datasets: map[string]*Dataset{},
-				logger:   logger,
-				metrics:  metrics,
-				config:   conf,
-				db:       tDB,
+				logger:  logger,
+				metrics: metrics,
+				config:  conf,
+				db:      tDB,
 			}
 			testLayer = l
 			err = l.UpdateConfiguration(conf)
@@ -88,18 +92,17 @@ func TestWebServer(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to create snowflake data layer: %v", err)
 		}
+		// Start returns before the server listens, so connection errors are retried until the timeout
 		ts := time.Now()
 		for {
 			health, err := http.Get("http://localhost:17866/health")
-			if err != nil {
-				t.Fatalf("failed to check health: %v", err)
-			}
-			if health.StatusCode == 200 {
+			if err == nil && health.StatusCode == 200 {
 				break
 			}
 			if time.Since(ts) > 10*time.Second {
-				t.Fatalf("failed to start server")
+				t.Fatalf("failed to start server: %v", err)
 			}
+			time.Sleep(10 * time.Millisecond)
 		}
 	}
 	cleanup := func() {
@@ -161,8 +164,8 @@ func TestWebServer(t *testing.T) {
 		t.Run("should return 500 if implicit parsing fails", func(t *testing.T) {
 			setup()
 			t.Cleanup(cleanup)
-			mock.ExpectQuery("SELECT ENTITY FROM testdb.testschema.foo-bar.baz").
-				WillReturnError(sql.ErrNoRows)
+			// names that are not valid identifiers are rejected before a session is opened
+			tDB.(*testDB).consumeSession()
 			resp, err := http.Get("http://localhost:17866/datasets/foo-bar.baz/entities")
 			if err != nil {
 				t.Fatalf("failed to get entities: %v", err)
@@ -171,13 +174,18 @@ func TestWebServer(t *testing.T) {
 			if resp.StatusCode != 500 {
 				t.Fatalf("expected 500, got %d", resp.StatusCode)
 			}
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(bodyBytes), `\"foo-bar_baz\" is not a valid snowflake identifier`) {
+				t.Fatalf("unexpected response body: %s", bodyBytes)
+			}
 		})
-		// ideally, it should return 400, but it returns 500 because we dont check what the underlying query error actually is caused by
-		t.Run("should return 500 if table not found", func(t *testing.T) {
+		// common-datalayer responds with 500 to all layer errors, the message tells what is missing
+		t.Run("should return not found error if table not found", func(t *testing.T) {
 			setup()
 			t.Cleanup(cleanup)
 			mock.ExpectQuery("SELECT ENTITY FROM foo.bar.notfound").
-				WillReturnError(sql.ErrNoRows)
+				WillReturnError(&gsf.SnowflakeError{Number: 2003, QueryID: "01b3",
+					Message: "SQL compilation error:\nObject 'FOO.BAR.NOTFOUND' does not exist or not authorized."})
 
 			resp, err := http.Get("http://localhost:17866/datasets/foo.bar.notfound/entities")
 			if err != nil {
@@ -186,9 +194,10 @@ func TestWebServer(t *testing.T) {
 			if resp.StatusCode != 500 {
 				t.Fatalf("expected 500, got %d", resp.StatusCode)
 			}
-			// bodyBytes, err := io.ReadAll(resp.Body)
-			// Expect(err).NotTo(HaveOccurred())
-			// Expect(string(bodyBytes)).To(Equal("{\"message\":\"Failed to query snowflake\"}\n"))
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if string(bodyBytes) != `{"message":"table foo.bar.notfound of dataset foo.bar.notfound not found"}`+"\n" {
+				t.Fatalf("unexpected response body: %s", bodyBytes)
+			}
 		})
 	})
 	t.Run("when getting entities with configured (explicit) dataset names", func(t *testing.T) {
@@ -236,6 +245,104 @@ func TestWebServer(t *testing.T) {
 				t.Fatalf("unexpected response body: %s", string(bodyBytes))
 			}
 		})
+		t.Run("should name the missing column before streaming", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "cucumber",
+				SourceConfig: map[string]any{TableName: "baz", Schema: "bar", Database: "foo", RawColumn: "ENTITY"},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectQuery("SELECT ENTITY FROM foo.bar.baz").
+				WillReturnError(&gsf.SnowflakeError{Number: 904, Message: "SQL compilation error: error line 1 at position 7\ninvalid identifier 'ENTITY'"})
+
+			resp, err := http.Get("http://localhost:17866/datasets/cucumber/entities")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if string(bodyBytes) != `{"message":"column ENTITY does not exist in table foo.bar.baz of dataset cucumber"}`+"\n" {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, bodyBytes)
+			}
+		})
+		t.Run("should report a missing table in the since query", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "cucumber",
+				SourceConfig: map[string]any{TableName: "baz", Schema: "bar", Database: "foo", RawColumn: "ENTITY", SinceColumn: "ts"},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectQuery("SELECT MAX\\(ts\\) FROM foo.bar.baz").
+				WillReturnError(&gsf.SnowflakeError{Number: 2003, Message: "Object 'FOO.BAR.BAZ' does not exist or not authorized."})
+
+			ds, lerr := testLayer.Dataset("cucumber")
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			_, lerr = ds.Entities("", 0)
+			if lerr == nil || !errors.Is(lerr.Underlying(), ErrNotFound) ||
+				lerr.Error() != "table foo.bar.baz of dataset cucumber not found" {
+				t.Fatalf("expected not found, got %v", lerr)
+			}
+		})
+		t.Run("should apply the static predicate and request filters as bound parameters", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "cucumber",
+				SourceConfig: map[string]any{TableName: "baz", Schema: "bar", Database: "foo", RawColumn: "ENTITY",
+					SinceColumn: "ts", Where: "tenant = 'x'", FilterColumns: []any{"country", "STATUS"}},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectQuery("SELECT MAX\\(ts\\) FROM foo.bar.baz WHERE \\(tenant = 'x'\\) and country = \\? and STATUS IN \\(\\?, \\?\\)$").
+				WithArgs("NO", "active", "on,hold").
+				WillReturnRows(sqlmock.NewRows([]string{"MAX"}).AddRow(12))
+			mock.ExpectQuery("SELECT ENTITY FROM foo.bar.baz WHERE \\(tenant = 'x'\\) and country = \\? and STATUS IN \\(\\?, \\?\\) "+
+				"and ts <= 12 LIMIT 10$").
+				WithArgs("NO", "active", "on,hold").
+				WillReturnRows(sqlmock.NewRows([]string{"ENTITY"}).AddRow(`{"id": "1", "props": {"foo": "bar"}, "refs": {}}`))
+
+			resp, err := http.Get("http://localhost:17866/datasets/" + url.PathEscape(`cucumber?status=active,on\,hold&country=NO`) + "/entities?limit=10")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 || !strings.Contains(string(bodyBytes), `{"id":"1","refs":{},"props":{"foo":"bar"}}`) {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, bodyBytes)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run("should reject filters on columns that are not allowed", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			tDB.(*testDB).consumeSession()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "cucumber",
+				SourceConfig: map[string]any{TableName: "baz", Schema: "bar", Database: "foo", FilterColumns: []any{"country"}},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			for name, expected := range map[string]string{
+				"cucumber?tenant=y":      "column tenant is not a filter column of dataset cucumber",
+				"cucumber?country=%zz":   "invalid filters for dataset cucumber: invalid URL escape \"%zz\"",
+				"foo.bar.baz?country=NO": "dataset foo.bar.baz not found, filters need a dataset definition",
+			} {
+				_, lerr := testLayer.Dataset(name)
+				if lerr == nil || lerr.Error() != expected {
+					t.Fatalf("expected %s, got %v", expected, lerr)
+				}
+			}
+			ds, lerr := testLayer.Dataset("cucumber?country=NO")
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			if _, lerr := ds.Incremental(context.Background()); lerr == nil ||
+				lerr.Error() != "dataset cucumber cannot be written with filters" {
+				t.Fatalf("expected write to be rejected, got %v", lerr)
+			}
+		})
 		t.Run("should return a continuation token when since column is configured", func(t *testing.T) {
 			setup()
 			t.Cleanup(cleanup)
@@ -550,7 +657,7 @@ func TestWebServer(t *testing.T) {
 				},
 			}
 			testLayer.UpdateConfiguration(cfg)
-			mock.ExpectQuery("SELECT id, name, color, origin, amt, for_sale FROM foo.bar.banana").
+			mock.ExpectQuery("SELECT id::VARCHAR AS id, name, color, origin, amt, for_sale FROM foo.bar.banana").
 				WillReturnRows(sqlmock.
 					NewRows([]string{"id", "name", "color", "origin", "amt", "for_sale"}).
 					AddRow("ns65:1", "Dole", "green", "Colombia", 546554, true).
@@ -707,45 +814,906 @@ func TestWebServer(t *testing.T) {
 			if e.Properties["http://banana/test/name"] != "Dole" {
 				t.Fatalf("expected name to be Dole, got %s", e.Properties["http://banana/test/name"])
 			}
-			if e.Properties["http://banana/test/color"] != "green" {
-				t.Fatalf("expected color to be green, got %s", e.Properties["http://banana/test/color"])
+			if e.Properties["http://banana/test/color"] != "green" {
+				t.Fatalf("expected color to be green, got %s", e.Properties["http://banana/test/color"])
+			}
+			if e.Properties["http://banana/test/amt"] != float64(546554) {
+				t.Fatalf("expected amount to be 546554, got %v", e.Properties["http://banana/test/amt"])
+			}
+			if e.Properties["http://banana/test/for_sale"] != true {
+				t.Fatalf("expected for_sale to be true, got %v", e.Properties["http://banana/test/for_sale"])
+			}
+			if len(e.References) != 1 {
+				t.Fatalf("expected 1 reference, got %d", len(e.References))
+			}
+			if e.References["http://banana/test/From"] != "http://banana/test/origin/Colombia" {
+				t.Fatalf("expected from to be http://banana/test/origin/Colombia, got %s", e.References["http://banana/test/From"])
+			}
+			e = coll.Entities[1]
+			if e.ID != "http://banana/test/id/2" {
+				t.Fatalf("expected id to be http://banana/test/id/2, got %s", e.ID)
+			}
+			if len(e.Properties) != 6 {
+				t.Fatalf("expected 6 properties, got %d", len(e.Properties))
+			}
+			if e.Properties["http://banana/test/name"] != "Chiquita" {
+				t.Fatalf("expected name to be Chiquita, got %s", e.Properties["http://banana/test/name"])
+			}
+			if e.Properties["http://banana/test/color"] != "yellow" {
+				t.Fatalf("expected color to be yellow, got %s", e.Properties["http://banana/test/color"])
+			}
+			if e.Properties["http://banana/test/amt"] != float64(157556) {
+				t.Fatalf("expected amount to be 157556, got %v", e.Properties["http://banana/test/amt"])
+			}
+			if e.Properties["http://banana/test/for_sale"] != false {
+				t.Fatalf("expected for_sale to be false, got %v", e.Properties["http://banana/test/for_sale"])
+			}
+			if len(e.References) != 1 {
+				t.Fatalf("expected 1 reference, got %d", len(e.References))
+			}
+			if e.References["http://banana/test/From"] != "http://banana/test/origin/Costa_Rica" {
+				t.Fatalf("expected from to be http://banana/test/origin/Costa_Rica, got %s", e.References["http://banana/test/From"])
+			}
+		})
+		t.Run("should cast typed columns and parse semi-structured columns", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "orders",
+				SourceConfig: map[string]any{TableName: "orders_view", Schema: "bar", Database: "foo"},
+				OutgoingMappingConfig: &common_datalayer.OutgoingMappingConfig{
+					BaseURI: "http://orders/",
+					PropertyMappings: []*common_datalayer.ItemToEntityPropertyMapping{
+						{Property: "id", IsIdentity: true, URIValuePattern: "http://orders/{value}"},
+						{Property: "amt", EntityProperty: "amt", Datatype: "int"},
+						{Property: "customer", EntityProperty: "customer", Datatype: "object"},
+						{Property: "tags", EntityProperty: "tags", Datatype: "array"},
+					},
+				},
+			}}
+			if lerr := testLayer.UpdateConfiguration(cfg); lerr != nil {
+				t.Fatal(lerr)
+			}
+			mock.ExpectQuery("SELECT id, amt::INTEGER AS amt, customer::OBJECT AS customer, tags::ARRAY AS tags " +
+				"FROM foo.bar.orders_view$").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "amt", "customer", "tags"}).
+					AddRow("1", "12", `{"name": "Ola", "address": {"city": "Oslo"}}`, `["a", 12345678901234567]`).
+					AddRow("2", "7", nil, "[]"))
+
+			resp, err := http.Get("http://localhost:17866/datasets/orders/entities")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, bodyBytes)
+			}
+			for _, expected := range []string{
+				`"http://orders/amt":12`,
+				`"http://orders/customer":{"refs":{},"props":{` +
+					`"http://orders/address":{"refs":{},"props":{"http://orders/city":"Oslo"}},"http://orders/name":"Ola"}}`,
+				`"http://orders/tags":["a",12345678901234567]`,
+				`"http://orders/tags":[]`,
+			} {
+				if !strings.Contains(string(bodyBytes), expected) {
+					t.Fatalf("expected %s in %s", expected, bodyBytes)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run("should fail on invalid semi-structured values", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "orders",
+				SourceConfig: map[string]any{TableName: "orders", Schema: "bar", Database: "foo"},
+				OutgoingMappingConfig: &common_datalayer.OutgoingMappingConfig{
+					BaseURI: "http://orders/",
+					PropertyMappings: []*common_datalayer.ItemToEntityPropertyMapping{
+						{Property: "id", IsIdentity: true, URIValuePattern: "http://orders/{value}"},
+						{Property: "customer", EntityProperty: "customer", Datatype: "variant"},
+					},
+				},
+			}}
+			if lerr := testLayer.UpdateConfiguration(cfg); lerr != nil {
+				t.Fatal(lerr)
+			}
+			mock.ExpectQuery("SELECT id, customer::VARIANT AS customer FROM foo.bar.orders$").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "customer"}).AddRow("1", "{not json"))
+
+			resp, err := http.Get("http://localhost:17866/datasets/orders/entities")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			// the stream has started, so the failure truncates the response
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if strings.Contains(string(bodyBytes), "http://orders/1") || strings.Contains(string(bodyBytes), "@continuation") {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, bodyBytes)
+			}
+		})
+	})
+	t.Run("when reading query datasets", func(t *testing.T) {
+		queryDataset := func() *common_datalayer.DatasetDefinition {
+			return &common_datalayer.DatasetDefinition{
+				DatasetName: "people",
+				SourceConfig: map[string]any{
+					Query: "SELECT p.id, p.name, a.city, p.ts FROM foo.bar.people p " +
+						"JOIN foo.bar.addresses a ON a.person_id = p.id WHERE p.country = ?",
+					QueryParams: []any{"NO"},
+					SinceColumn: "ts",
+				},
+				OutgoingMappingConfig: &common_datalayer.OutgoingMappingConfig{
+					BaseURI: "http://people/",
+					PropertyMappings: []*common_datalayer.ItemToEntityPropertyMapping{
+						{Property: "id", IsIdentity: true, URIValuePattern: "http://people/{value}"},
+						{Property: "name", EntityProperty: "name"},
+						{Property: "city", EntityProperty: "city"},
+					},
+				},
+			}
+		}
+		explain := "EXPLAIN USING TEXT SELECT p.id, p.name, a.city, p.ts FROM foo.bar.people p " +
+			"JOIN foo.bar.addresses a ON a.person_id = p.id WHERE p.country = \\?"
+		t.Run("should compile the query at config load and read it as subquery", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			// the query is compiled in a layer session, which is expected by newTestDB
+			mock.ExpectQuery(explain).WithArgs("NO").
+				WillReturnRows(sqlmock.NewRows([]string{"step"}).AddRow("GlobalStats"))
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{queryDataset()}
+			if lerr := testLayer.UpdateConfiguration(cfg); lerr != nil {
+				t.Fatal(lerr)
+			}
+
+			tDB.(*testDB).ExpectConn()
+			mock.ExpectQuery("SELECT MAX\\(ts\\) FROM \\(SELECT p.id, .* WHERE p.country = \\?\\) AS q$").
+				WithArgs("NO").
+				WillReturnRows(sqlmock.NewRows([]string{"MAX"}).AddRow(7))
+			mock.ExpectQuery("SELECT id, name, city FROM \\(SELECT p.id, .* WHERE p.country = \\?\\) AS q " +
+				"WHERE ts <= 7 LIMIT 5$").
+				WithArgs("NO").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "city"}).AddRow("1", "Ola", "Oslo"))
+
+			resp, err := http.Get("http://localhost:17866/datasets/people/entities?limit=5")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != 200 ||
+				!strings.Contains(string(bodyBytes), `"props":{"http://people/city":"Oslo","http://people/name":"Ola"}`) {
+				t.Fatalf("unexpected response %d: %s", resp.StatusCode, bodyBytes)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run("should reject a query that does not compile", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			mock.ExpectQuery(explain).WithArgs("NO").
+				WillReturnError(&gsf.SnowflakeError{Number: 2003,
+					Message: "SQL compilation error:\nObject 'FOO.BAR.ADDRESSES' does not exist or not authorized."})
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{queryDataset()}
+			lerr := testLayer.UpdateConfiguration(cfg)
+			if lerr == nil || !strings.Contains(lerr.Error(), "dataset people: invalid query: ") ||
+				!strings.Contains(lerr.Error(), "FOO.BAR.ADDRESSES") {
+				t.Fatalf("expected invalid query, got %v", lerr)
+			}
+			if _, found := testLayer.registry().get("people"); found {
+				t.Fatal("invalid dataset should not be added")
+			}
+		})
+		t.Run("should keep a query that cannot be compiled for other reasons", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			mock.ExpectQuery(explain).WithArgs("NO").
+				WillReturnError(&gsf.SnowflakeError{Number: 390114, SQLState: "08001",
+					Message: "Authentication token has expired."})
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{queryDataset()}
+			if lerr := testLayer.UpdateConfiguration(cfg); lerr != nil {
+				t.Fatalf("expected the definition to be kept, got %v", lerr)
+			}
+			if _, found := testLayer.registry().get("people"); !found {
+				t.Fatal("expected dataset people")
+			}
+		})
+		t.Run("should not write to query datasets", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			mock.ExpectQuery(explain).WithArgs("NO").
+				WillReturnRows(sqlmock.NewRows([]string{"step"}).AddRow("GlobalStats"))
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{queryDataset()}
+			testLayer.UpdateConfiguration(cfg)
+			ds, lerr := testLayer.Dataset("people")
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			if _, lerr = ds.Incremental(context.Background()); lerr == nil || !errors.Is(lerr.Underlying(), ErrForbidden) {
+				t.Fatalf("expected forbidden, got %v", lerr)
+			}
+		})
+	})
+	t.Run("when a dataset denies access", func(t *testing.T) {
+		t.Run("should reject requests with the responses of the web service", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			tDB.(*testDB).consumeSession()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{AllowRead: false, AllowWrite: false},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {}}]`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusInternalServerError || !strings.Contains(string(b), "could not create dataset writer") {
+				t.Fatalf("expected denied write, got %d %s", res.StatusCode, b)
+			}
+
+			res, err = http.Get("http://localhost:17866/datasets/potatoe/entities")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ = io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusInternalServerError || !strings.Contains(string(b), "forbidden: dataset potatoe does not allow reads") {
+				t.Fatalf("expected denied read, got %d %s", res.StatusCode, b)
+			}
+		})
+	})
+	t.Run("when listing datasets", func(t *testing.T) {
+		t.Run("should list configured and discovered tables, and cache them", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			// discovery does not open a session, consume the session setup expected by newTestDB
+			tDB.(*testDB).consumeSession()
+			testLayer.config.NativeSystemConfig[DiscoverySchemas] = []any{"otherdb.otherschema", "testdb.raw"}
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe"},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			// only tables with an ENTITY column can be read by name
+			mock.ExpectQuery("SELECT t.TABLE_SCHEMA, t.TABLE_NAME FROM TESTDB.INFORMATION_SCHEMA.TABLES t .* "+
+				"WHERE t.TABLE_SCHEMA IN \\(\\?, \\?\\) AND c.COLUMN_NAME = 'ENTITY'").
+				WithArgs("TESTSCHEMA", "RAW").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+					AddRow("RAW", "EVENTS").
+					AddRow("TESTSCHEMA", "POTATOE").
+					AddRow("TESTSCHEMA", "S_POTATOE_FSID_1").
+					AddRow("TESTSCHEMA", "TOMATOE"))
+			mock.ExpectQuery("FROM OTHERDB.INFORMATION_SCHEMA.TABLES").
+				WithArgs("OTHERSCHEMA").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+					AddRow("OTHERSCHEMA", "PEOPLE"))
+
+			for i := 0; i < 2; i++ {
+				res, err := http.Get("http://localhost:17866/datasets")
+				if err != nil {
+					t.Fatalf("failed to list datasets: %v", err)
+				}
+				if res.StatusCode != 200 {
+					t.Fatalf("expected 200, got %d", res.StatusCode)
+				}
+				var descriptions []*common_datalayer.DatasetDescription
+				if err := json.NewDecoder(res.Body).Decode(&descriptions); err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, d := range descriptions {
+					names = append(names, d.Name)
+				}
+				expected := "potatoe,TESTDB.RAW.EVENTS,TESTDB.TESTSCHEMA.TOMATOE,OTHERDB.OTHERSCHEMA.PEOPLE"
+				if strings.Join(names, ",") != expected {
+					t.Fatalf("expected %s, got %v", expected, names)
+				}
+				if descriptions[1].Metadata[TableName] != "EVENTS" {
+					t.Fatalf("expected table name in metadata, got %v", descriptions[1].Metadata)
+				}
+			}
+		})
+		t.Run("should not list discovered tables that cannot be read by name", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			tDB.(*testDB).consumeSession()
+			testLayer.config.NativeSystemConfig[ImplicitReadDeny] = []any{"*.*.TOMATOE"}
+			cfg.DatasetDefinitions = nil
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectQuery("FROM TESTDB.INFORMATION_SCHEMA.TABLES").
+				WithArgs("TESTSCHEMA").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+					AddRow("TESTSCHEMA", "POTATOE").
+					AddRow("TESTSCHEMA", "TOMATOE"))
+
+			res, err := http.Get("http://localhost:17866/datasets")
+			if err != nil {
+				t.Fatalf("failed to list datasets: %v", err)
+			}
+			var descriptions []*common_datalayer.DatasetDescription
+			if err := json.NewDecoder(res.Body).Decode(&descriptions); err != nil {
+				t.Fatal(err)
+			}
+			if len(descriptions) != 1 || descriptions[0].Name != "TESTDB.TESTSCHEMA.POTATOE" {
+				t.Fatalf("unexpected datasets %v", descriptions)
+			}
+
+			res, err = http.Get("http://localhost:17866/datasets/TESTDB.TESTSCHEMA.TOMATOE/entities")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			if !strings.Contains(string(b), "dataset TESTDB.TESTSCHEMA.TOMATOE not found") {
+				t.Fatalf("expected not found, got %d %s", res.StatusCode, b)
+			}
+		})
+		t.Run("should not list tables without ENTITY column, since they cannot be read by name", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = nil
+			testLayer.UpdateConfiguration(cfg)
+			// POTATOE was written with column mappings, and has no ENTITY column
+			mock.ExpectQuery("SELECT ENTITY FROM TESTDB.TESTSCHEMA.POTATOE").
+				WillReturnError(&gsf.SnowflakeError{Number: 904, Message: "SQL compilation error: error line 1 at position 7\ninvalid identifier 'ENTITY'"})
+			mock.ExpectQuery("FROM TESTDB.INFORMATION_SCHEMA.TABLES .* AND c.COLUMN_NAME = 'ENTITY'").
+				WithArgs("TESTSCHEMA").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+					AddRow("TESTSCHEMA", "TOMATOE"))
+
+			res, err := http.Get("http://localhost:17866/datasets/TESTDB.TESTSCHEMA.POTATOE/entities")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			if !strings.Contains(string(b), "column ENTITY does not exist in table TESTDB.TESTSCHEMA.POTATOE") {
+				t.Fatalf("expected missing ENTITY column, got %d %s", res.StatusCode, b)
+			}
+
+			res, err = http.Get("http://localhost:17866/datasets")
+			if err != nil {
+				t.Fatalf("failed to list datasets: %v", err)
+			}
+			var descriptions []*common_datalayer.DatasetDescription
+			if err := json.NewDecoder(res.Body).Decode(&descriptions); err != nil {
+				t.Fatal(err)
+			}
+			if len(descriptions) != 1 || descriptions[0].Name != "TESTDB.TESTSCHEMA.TOMATOE" {
+				t.Fatalf("unexpected datasets %v", descriptions)
+			}
+		})
+		t.Run("should only list configured datasets when discovery is disabled", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			tDB.(*testDB).consumeSession()
+			testLayer.config.NativeSystemConfig[DiscoverTables] = false
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{DatasetName: "potatoe"}}
+			testLayer.UpdateConfiguration(cfg)
+
+			res, err := http.Get("http://localhost:17866/datasets")
+			if err != nil {
+				t.Fatalf("failed to list datasets: %v", err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			expected := `[{"metadata":{"full_sync_in_progress":false,"resolved_database":"TESTDB",` +
+				`"resolved_schema":"TESTSCHEMA","resolved_table":"POTATOE"},"name":"potatoe","description":""}]`
+			if string(b) != expected {
+				t.Fatalf("unexpected datasets: %s", b)
+			}
+		})
+	})
+	t.Run("when reporting metrics", func(t *testing.T) {
+		t.Run("should report put, copy and merge metrics of a write", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			metrics := &testMetrics{}
+			testLayer.db.(*testDB).sfDB.metrics = metrics
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe", LatestTable: true},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(
+				sqlmock.NewRows([]string{"file", "status", "rows_parsed", "rows_loaded"}).
+					AddRow("a.gz", "LOADED", "2", "2").AddRow("b.gz", "LOADED", "3", "3"))
+			mock.ExpectQuery("MERGE INTO TESTDB.TESTSCHEMA.POTATOE_LATEST").WillReturnRows(
+				sqlmock.NewRows([]string{"number of rows inserted", "number of rows updated"}).AddRow("4", "1"))
+			mock.ExpectCommit()
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			for name, expected := range map[string]any{
+				"snowflake.put.files":           1,
+				"snowflake.copy.rows_loaded":    float64(5),
+				"snowflake.merge.rows_inserted": float64(4),
+				"snowflake.merge.rows_updated":  float64(1),
+			} {
+				if metrics.get(name) != expected {
+					t.Fatalf("expected %s to be %v, got %v", name, expected, metrics.get(name))
+				}
+			}
+			for _, name := range []string{"snowflake.put.duration", "snowflake.put.bytes", "snowflake.copy.duration", "snowflake.merge.duration"} {
+				if metrics.get(name) == nil {
+					t.Fatalf("expected %s to be reported, got %v", name, metrics.metrics)
+				}
+			}
+			if tags := strings.Join(metrics.tags["snowflake.merge.rows_inserted"], ","); tags != "dataset:potatoe,operation:merge" {
+				t.Fatalf("expected dataset and operation tags, got %s", tags)
+			}
+		})
+		t.Run("should report query and iteration metrics of a read", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			metrics := &testMetrics{}
+			testLayer.db.(*testDB).sfDB.metrics = metrics
+			mock.ExpectQuery("SELECT ENTITY FROM foo.bar.baz").
+				WillReturnRows(sqlmock.NewRows([]string{"ENTITY"}).
+					AddRow(`{"id": "1", "props": {}, "refs": {}}`).
+					AddRow(`{"id": "2", "props": {}, "refs": {}}`))
+			resp, err := http.Get("http://localhost:17866/datasets/foo.bar.baz/entities")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			_, _ = io.ReadAll(resp.Body)
+			if metrics.get("snowflake.iterate.rows") != float64(2) || metrics.get("snowflake.query.duration") == nil {
+				t.Fatalf("expected query and iteration metrics, got %v", metrics.metrics)
+			}
+			if tags := strings.Join(metrics.tags["snowflake.iterate.rows"], ","); tags != "dataset:foo.bar.baz,operation:iterate" {
+				t.Fatalf("expected dataset and operation tags, got %s", tags)
+			}
+		})
+	})
+	t.Run("when tracing", func(t *testing.T) {
+		t.Run("should trace a write from request to merge", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			spans := recordSpans(t)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe", LatestTable: true},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(
+				sqlmock.NewRows([]string{"file", "status", "rows_parsed", "rows_loaded"}).AddRow("a.gz", "LOADED", "2", "2"))
+			mock.ExpectQuery("MERGE INTO TESTDB.TESTSCHEMA.POTATOE_LATEST").WillReturnRows(
+				sqlmock.NewRows([]string{"number of rows inserted", "number of rows updated"}).AddRow("1", "1"))
+			mock.ExpectCommit()
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}},
+{"id": "x:2", "props": {"x:foo": "baz"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			root := spanNamed(spans, "snowflake.incremental")
+			if root == nil {
+				t.Fatalf("expected request span, got %v", spans.GetSpans())
+			}
+			if spanAttr(root, "dataset") != "potatoe" || spanAttr(root, "entities") != int64(2) || spanAttr(root, "files") != int64(1) {
+				t.Fatalf("unexpected request span attributes %v", root.Attributes)
+			}
+			for name, attrs := range map[string]map[string]any{
+				"snowflake.put":        {"entities": int64(2)},
+				"snowflake.load_files": {"files": int64(1)},
+				"snowflake.copy":       {"rows_loaded": int64(2)},
+				"snowflake.merge":      {"rows_inserted": int64(1), "rows_updated": int64(1)},
+			} {
+				span := spanNamed(spans, name)
+				if span == nil {
+					t.Fatalf("expected span %s, got %v", name, spans.GetSpans())
+				}
+				if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+					t.Fatalf("expected %s in the trace of the request", name)
+				}
+				for k, v := range attrs {
+					if spanAttr(span, k) != v {
+						t.Fatalf("expected %s of %s to be %v, got %v", k, name, v, spanAttr(span, k))
+					}
+				}
+			}
+			if spanNamed(spans, "snowflake.copy").Parent.SpanID() != spanNamed(spans, "snowflake.load_files").SpanContext.SpanID() {
+				t.Fatal("expected copy to be a child of load_files")
+			}
+		})
+		t.Run("should record failed statements as span errors", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			spans := recordSpans(t)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe"},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnError(fmt.Errorf("copy failed"))
+			mock.ExpectRollback()
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode == 200 {
+				t.Fatal("expected the write to fail")
+			}
+			for _, name := range []string{"snowflake.copy", "snowflake.load_files", "snowflake.incremental"} {
+				span := spanNamed(spans, name)
+				if span == nil || span.Status.Code != codes.Error || span.Status.Description != "copy failed" {
+					t.Fatalf("expected %s to fail with copy failed, got %+v", name, span)
+				}
+			}
+		})
+		t.Run("should trace a read from query to iteration", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			spans := recordSpans(t)
+			mock.ExpectQuery("SELECT ENTITY FROM foo.bar.baz").
+				WillReturnRows(sqlmock.NewRows([]string{"ENTITY"}).
+					AddRow(`{"id": "1", "props": {}, "refs": {}}`).
+					AddRow(`{"id": "2", "props": {}, "refs": {}}`))
+			resp, err := http.Get("http://localhost:17866/datasets/foo.bar.baz/entities")
+			if err != nil {
+				t.Fatalf("failed to get entities: %v", err)
+			}
+			_, _ = io.ReadAll(resp.Body)
+			root := spanNamed(spans, "snowflake.read")
+			if root == nil || spanAttr(root, "dataset") != "foo.bar.baz" || spanAttr(root, "rows") != int64(2) {
+				t.Fatalf("expected read span with dataset and rows, got %+v", root)
+			}
+			for _, name := range []string{"snowflake.query", "snowflake.iterate"} {
+				span := spanNamed(spans, name)
+				if span == nil || span.Parent.SpanID() != root.SpanContext.SpanID() {
+					t.Fatalf("expected %s to be a child of the read span, got %+v", name, span)
+				}
+			}
+			if spanAttr(spanNamed(spans, "snowflake.iterate"), "rows") != int64(2) {
+				t.Fatal("expected row count on iterate span")
+			}
+		})
+	})
+	t.Run("when reading dataset metadata", func(t *testing.T) {
+		t.Run("should report table facts and load state", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe", LatestTable: true},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectQuery("MERGE INTO TESTDB.TESTSCHEMA.POTATOE_LATEST").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectCommit()
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+
+			mock.ExpectQuery("SELECT COLUMN_NAME, DATA_TYPE FROM TESTDB.INFORMATION_SCHEMA.COLUMNS").
+				WithArgs("TESTSCHEMA", "POTATOE").
+				WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}).
+					AddRow("ID", "TEXT").AddRow("RECORDED", "NUMBER"))
+			mock.ExpectQuery("SELECT TABLE_NAME, ROW_COUNT FROM TESTDB.INFORMATION_SCHEMA.TABLES").
+				WithArgs("TESTSCHEMA", "POTATOE", "POTATOE_LATEST").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_NAME", "ROW_COUNT"}).
+					AddRow("POTATOE", 12).AddRow("POTATOE_LATEST", 7))
+			ds, lerr := testLayer.Dataset("potatoe")
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			md := ds.MetaData()
+			if md[TableName] != "potatoe" || md["resolved_table"] != "POTATOE" || md["resolved_database"] != "TESTDB" {
+				t.Fatalf("expected source config and resolved table, got %v", md)
+			}
+			if md["row_count"] != int64(12) || md["latest_row_count"] != int64(7) {
+				t.Fatalf("expected row counts, got %v and %v", md["row_count"], md["latest_row_count"])
+			}
+			if cols := md["columns"].([]map[string]string); len(cols) != 2 || cols[1]["type"] != "NUMBER" {
+				t.Fatalf("unexpected columns %v", md["columns"])
+			}
+			if md["last_incremental_load"] == nil || md["last_full_sync"] != nil || md["full_sync_in_progress"] != false {
+				t.Fatalf("unexpected load state %v", md)
+			}
+		})
+		t.Run("should list load state and serve table facts on the health server", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe"},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			testLayer.config.NativeSystemConfig[DiscoverTables] = false
+			// the metadata queries do not set up the session, consume the expectations of newTestDB
+			tDB.(*testDB).consumeSession()
+
+			// a full sync that ran longer than full_sync_timeout is no longer in progress
+			testLayer.loadStates.get("potatoe").fullSyncStart("sync1", time.Now().Add(-7*time.Hour))
+			descriptions := testLayer.DatasetDescriptions()
+			if len(descriptions) != 1 || descriptions[0].Metadata["resolved_table"] != "POTATOE" ||
+				descriptions[0].Metadata["full_sync_in_progress"] != false {
+				t.Fatalf("expected metadata of potatoe, got %+v", descriptions)
+			}
+			testLayer.loadStates.get("potatoe").fullSyncStart("sync2", time.Now())
+			if md := testLayer.DatasetDescriptions()[0].Metadata; md["full_sync_in_progress"] != true {
+				t.Fatalf("expected full sync in progress, got %v", md)
+			}
+
+			mock.ExpectQuery("SELECT COLUMN_NAME, DATA_TYPE FROM TESTDB.INFORMATION_SCHEMA.COLUMNS").
+				WithArgs("TESTSCHEMA", "POTATOE").
+				WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "DATA_TYPE"}).AddRow("ID", "TEXT"))
+			mock.ExpectQuery("SELECT TABLE_NAME, ROW_COUNT FROM TESTDB.INFORMATION_SCHEMA.TABLES").
+				WithArgs("TESTSCHEMA", "POTATOE", "POTATOE_LATEST").
+				WillReturnRows(sqlmock.NewRows([]string{"TABLE_NAME", "ROW_COUNT"}).AddRow("POTATOE", 12))
+			rec := httptest.NewRecorder()
+			testLayer.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/datasets/potatoe/metadata", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rec.Code)
+			}
+			var md map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &md); err != nil {
+				t.Fatal(err)
+			}
+			if md["row_count"] != float64(12) || md["resolved_table"] != "POTATOE" {
+				t.Fatalf("expected table facts, got %v", md)
+			}
+
+			rec = httptest.NewRecorder()
+			testLayer.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/datasets/unknown/metadata", nil))
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected 404, got %d", rec.Code)
+			}
+		})
+	})
+	t.Run("when running preflight checks", func(t *testing.T) {
+		t.Run("should report every probe and fail strict startup", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{
+				{DatasetName: "reader", SourceConfig: map[string]any{TableName: "people", RawColumn: "ENTITY"}},
+				{DatasetName: "writer"},
+			}
+			testLayer.UpdateConfiguration(cfg)
+			// session setup is expected by newTestDB
+			mock.ExpectExec("USE WAREHOUSE TESTWH;").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("USE SCHEMA TESTDB.TESTSCHEMA;").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TEMPORARY STAGE TESTDB.TESTSCHEMA.DATALAYER_PREFLIGHT;").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TEMPORARY TABLE TESTDB.TESTSCHEMA.DATALAYER_PREFLIGHT").
+				WillReturnError(fmt.Errorf("insufficient privileges"))
+			mock.ExpectExec("DROP STAGE IF EXISTS TESTDB.TESTSCHEMA.DATALAYER_PREFLIGHT;").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("DROP TABLE IF EXISTS TESTDB.TESTSCHEMA.DATALAYER_PREFLIGHT;").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("SELECT 1 FROM TESTDB.TESTSCHEMA.PEOPLE LIMIT 0;").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			testLayer.config.NativeSystemConfig[PreflightMode] = PreflightStrict
+			err := testLayer.startupPreflight()
+			if err == nil || err.Error() != "preflight checks failed: create table: insufficient privileges" {
+				t.Fatalf("expected strict preflight to fail, got %v", err)
+			}
+
+			rec := httptest.NewRecorder()
+			testLayer.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/preflight", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected 503, got %d", rec.Code)
+			}
+			var report preflightReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, p := range report.Probes {
+				names = append(names, fmt.Sprintf("%s=%v", p.Name, p.OK))
+			}
+			expected := "connection=true,warehouse usage=true,schema usage=true,create stage=true,create table=false,select reader=true"
+			if strings.Join(names, ",") != expected {
+				t.Fatalf("expected %s, got %v", expected, names)
+			}
+		})
+	})
+	t.Run("when the layer is low on memory", func(t *testing.T) {
+		t.Run("should reject requests with the responses of the web service", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			t.Cleanup(func() {
+				memoryStats = ReadMemoryStats
+				memoryCheckInterval = 1000
+			})
+			lowMemory := func() Memory { return Memory{Current: 900 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+			enoughMemory := func() Memory { return Memory{Current: 100 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{DatasetName: "potatoe"}}
+			testLayer.UpdateConfiguration(cfg)
+			body := `[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]`
+			post := func() (int, string) {
+				res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json", strings.NewReader(body))
+				if err != nil {
+					t.Fatalf("failed to post entities: %v", err)
+				}
+				b, _ := io.ReadAll(res.Body)
+				return res.StatusCode, string(b)
+			}
+
+			memoryStats = lowMemory
+			if code, b := post(); code != http.StatusBadRequest || !strings.Contains(b, "could not find dataset potatoe") {
+				t.Fatalf("expected rejection of the request, got %d %s", code, b)
+			}
+
+			res, err := http.Get("http://localhost:17866/datasets/potatoe/entities")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusInternalServerError || !strings.Contains(string(b), "rejecting request: retry after 30s") {
+				t.Fatalf("expected back-off hint, got %d %s", res.StatusCode, b)
+			}
+
+			// memory is checked when the request starts, and for every buffered entity
+			memoryCheckInterval = 1
+			checks := 0
+			memoryStats = func() Memory {
+				checks++
+				if checks > 1 {
+					return lowMemory()
+				}
+				return enoughMemory()
 			}
-			if e.Properties["http://banana/test/amt"] != float64(546554) {
-				t.Fatalf("expected amount to be 546554, got %v", e.Properties["http://banana/test/amt"])
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			if code, b := post(); code != http.StatusBadRequest || !strings.Contains(b, "could not parse the json payload") {
+				t.Fatalf("expected rejection of the write, got %d %s", code, b)
 			}
-			if e.Properties["http://banana/test/for_sale"] != true {
-				t.Fatalf("expected for_sale to be true, got %v", e.Properties["http://banana/test/for_sale"])
+		})
+	})
+	t.Run("when checking readiness", func(t *testing.T) {
+		ready := func(t *testing.T) (int, readinessReport) {
+			rec := httptest.NewRecorder()
+			testLayer.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+			var report readinessReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			return rec.Code, report
+		}
+		t.Run("should combine connectivity, memory and full sync state", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			t.Cleanup(func() { memoryStats = ReadMemoryStats })
+			memoryStats = func() Memory { return Memory{Current: 100 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+			// the connectivity check does not set up the session, consume the expectations of newTestDB
+			tDB.(*testDB).consumeSession()
+
+			code, report := ready(t)
+			if code != http.StatusServiceUnavailable || report.Snowflake.Error != "not checked yet" {
+				t.Fatalf("expected unready before first check, got %d %+v", code, report)
 			}
-			if len(e.References) != 1 {
-				t.Fatalf("expected 1 reference, got %d", len(e.References))
+
+			mock.ExpectExec("SELECT 1;").WillReturnResult(sqlmock.NewResult(0, 0))
+			testLayer.checkConnectivity(context.Background(), time.Second)
+			code, report = ready(t)
+			if code != http.StatusOK || !report.Ready || *report.Memory.HeadroomBytes != 900*1000*1000 {
+				t.Fatalf("expected ready, got %d %+v", code, report)
 			}
-			if e.References["http://banana/test/From"] != "http://banana/test/origin/Colombia" {
-				t.Fatalf("expected from to be http://banana/test/origin/Colombia, got %s", e.References["http://banana/test/From"])
+
+			testLayer.loadStates.get("people").fullSyncStart("sync1", time.Now().Add(-7*time.Hour))
+			testLayer.loadStates.get("places").fullSyncStart("sync2", time.Now())
+			code, report = ready(t)
+			if code != http.StatusServiceUnavailable || strings.Join(report.FullSyncs.Stuck, ",") != "people" {
+				t.Fatalf("expected stuck full sync of people, got %d %+v", code, report)
 			}
-			e = coll.Entities[1]
-			if e.ID != "http://banana/test/id/2" {
-				t.Fatalf("expected id to be http://banana/test/id/2, got %s", e.ID)
+			testLayer.loadStates.get("people").fullSyncLoaded(time.Now())
+
+			memoryStats = func() Memory { return Memory{Current: 900 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+			code, report = ready(t)
+			if code != http.StatusServiceUnavailable || report.Memory.OK {
+				t.Fatalf("expected low memory, got %d %+v", code, report)
 			}
-			if len(e.Properties) != 6 {
-				t.Fatalf("expected 6 properties, got %d", len(e.Properties))
+			memoryStats = func() Memory { return Memory{} }
+
+			mock.ExpectExec("SELECT 1;").WillReturnError(fmt.Errorf("connection refused"))
+			testLayer.checkConnectivity(context.Background(), time.Second)
+			code, report = ready(t)
+			if code != http.StatusServiceUnavailable || report.Snowflake.Error != "connection refused" || !report.Memory.OK {
+				t.Fatalf("expected failed connectivity, got %d %+v", code, report)
 			}
-			if e.Properties["http://banana/test/name"] != "Chiquita" {
-				t.Fatalf("expected name to be Chiquita, got %s", e.Properties["http://banana/test/name"])
+
+			rec := httptest.NewRecorder()
+			testLayer.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected live, got %d", rec.Code)
 			}
-			if e.Properties["http://banana/test/color"] != "yellow" {
-				t.Fatalf("expected color to be yellow, got %s", e.Properties["http://banana/test/color"])
+		})
+		t.Run("should recover from an abandoned full sync", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			t.Cleanup(func() { memoryStats = ReadMemoryStats })
+			memoryStats = func() Memory { return Memory{} }
+			tDB.(*testDB).consumeSession()
+			mock.ExpectExec("SELECT 1;").WillReturnResult(sqlmock.NewResult(0, 0))
+			testLayer.checkConnectivity(context.Background(), time.Second)
+
+			people := testLayer.loadStates.get("people")
+			people.fullSyncStart("sync1", time.Now().Add(-7*time.Hour))
+			if code, report := ready(t); code != http.StatusServiceUnavailable || strings.Join(report.FullSyncs.Stuck, ",") != "people" {
+				t.Fatalf("expected stuck full sync of people, got %d %+v", code, report)
+			}
+			// the next successful write ends the stuck state
+			people.incrementalLoaded(time.Now())
+			if code, report := ready(t); code != http.StatusOK || len(report.FullSyncs.Stuck) != 0 {
+				t.Fatalf("expected ready after a write, got %d %+v", code, report)
+			}
+			// without writes, the stuck state ends after another full_sync_timeout
+			testLayer.loadStates.get("places").fullSyncStart("sync2", time.Now().Add(-13*time.Hour))
+			if code, report := ready(t); code != http.StatusOK || len(report.FullSyncs.Stuck) != 0 {
+				t.Fatalf("expected ready after twice the timeout, got %d %+v", code, report)
 			}
-			if e.Properties["http://banana/test/amt"] != float64(157556) {
-				t.Fatalf("expected amount to be 157556, got %v", e.Properties["http://banana/test/amt"])
+		})
+		t.Run("should only track the load state of implicit datasets when they are written", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			t.Cleanup(func() { memoryStats = ReadMemoryStats })
+			memoryStats = func() Memory { return Memory{} }
+			tDB.(*testDB).consumeSession()
+			tracked := func() (names []string) {
+				testLayer.loadStates.m.Range(func(key, _ any) bool {
+					names = append(names, key.(string))
+					return true
+				})
+				return names
 			}
-			if e.Properties["http://banana/test/for_sale"] != false {
-				t.Fatalf("expected for_sale to be false, got %v", e.Properties["http://banana/test/for_sale"])
+
+			for _, name := range []string{"TESTDB.TESTSCHEMA.PEOPLE", "people", "no-such.table", "a.b.c.d"} {
+				testLayer.Dataset(name)
 			}
-			if len(e.References) != 1 {
-				t.Fatalf("expected 1 reference, got %d", len(e.References))
+			if names := tracked(); len(names) != 0 {
+				t.Fatalf("expected no load states before a write, got %v", names)
 			}
-			if e.References["http://banana/test/From"] != "http://banana/test/origin/Costa_Rica" {
-				t.Fatalf("expected from to be http://banana/test/origin/Costa_Rica, got %s", e.References["http://banana/test/From"])
+			ds, lerr := testLayer.Dataset("people")
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			ds.(*Dataset).loadState().incrementalLoaded(time.Now())
+			if names := tracked(); len(names) != 1 || names[0] != "people" {
+				t.Fatalf("expected load state of people, got %v", names)
 			}
 		})
 	})
@@ -776,9 +1744,9 @@ func TestWebServer(t *testing.T) {
 			//mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON'").WillReturnResult(sqlmock.NewResult(1, 1))
 			//mock.ExpectExec("USE SECONDARY ROLES ALL").WillReturnResult(sqlmock.NewResult(1, 1))
 
-			mock.ExpectBegin()
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE \\( id varchar, recorded integer," +
 				" deleted boolean, dataset varchar, entity variant \\);").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
 			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE\\(id, recorded, deleted, dataset, entity\\) FROM \\( " +
 				"SELECT \\$1:id::varchar, \\d+::integer, coalesce\\(\\$1:deleted::boolean, false\\), 'testdb.testschema.potatoe'::varchar, " +
 				"\\$1::variant as entity FROM @TESTDB.TESTSCHEMA.S_POTATOE" +
@@ -820,6 +1788,37 @@ func TestWebServer(t *testing.T) {
 				t.Fatalf("unexpected gzip file: %s", string(bytes))
 			}
 		})
+		t.Run("should split writes by batch size and copy files in chunks", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName:  "potatoe",
+				SourceConfig: map[string]any{TableName: "potatoe", BatchSize: 1, MaxFilesPerCopy: 1},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE.* FILES = \\('zip[0-9]+'\\);").
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE.* FILES = \\('zip[0-9]+'\\);").
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectCommit()
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}},
+{"id": "x:2", "props": {"x:foo": "baz"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+		})
 		t.Run("PUT gzipped mapped files in a stage and load specified files", func(t *testing.T) {
 			setup()
 			t.Cleanup(cleanup)
@@ -879,9 +1878,9 @@ func TestWebServer(t *testing.T) {
 			//mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON'").WillReturnResult(sqlmock.NewResult(1, 1))
 			//mock.ExpectExec("USE SECONDARY ROLES ALL").WillReturnResult(sqlmock.NewResult(1, 1))
 
-			mock.ExpectBegin()
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS SFDB2.SFS2.POTATOE \\( id varchar, recorded integer," +
 				" deleted boolean, dataset varchar, foo varchar, ok boolean, num integer, baz varchar \\);").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
 			mock.ExpectQuery("COPY INTO SFDB2.SFS2.POTATOE\\(id, recorded, deleted, dataset, foo, ok, num, baz\\) FROM \\( " +
 				"SELECT \\$1:id::varchar, \\d+::integer, coalesce\\(\\$1:deleted::boolean, false\\), 'potatoes'::varchar, " +
 				"\\$1:props:\"foo\"::varchar as foo, " +
@@ -967,12 +1966,12 @@ func TestWebServer(t *testing.T) {
 			//mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON'").WillReturnResult(sqlmock.NewResult(1, 1))
 			//mock.ExpectExec("USE SECONDARY ROLES ALL").WillReturnResult(sqlmock.NewResult(1, 1))
 
-			mock.ExpectBegin()
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE \\( id varchar, recorded integer," +
 				" deleted boolean, dataset varchar, entity variant \\);").WillReturnResult(sqlmock.NewResult(1, 1))
 
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST \\( id varchar, " +
 				"recorded integer, deleted boolean, dataset varchar, entity variant \\)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
 
 			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE\\(id, recorded, deleted, dataset, entity\\) FROM \\( " +
 				"SELECT \\$1:id::varchar, \\d+::integer, coalesce\\(\\$1:deleted::boolean, false\\), 'potatoe'::varchar, " +
@@ -1082,13 +2081,13 @@ func TestWebServer(t *testing.T) {
 			mock.ExpectQuery(fmt.Sprintf(`PUT file://%v`, f.Name())).
 				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
 
-			mock.ExpectBegin()
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS SFDB2.SFS2.POTATOE \\( id varchar, recorded integer," +
 				" deleted boolean, dataset varchar, foo varchar, ok boolean, num integer, baz varchar \\);").WillReturnResult(sqlmock.NewResult(1, 1))
 
 			mock.ExpectExec("CREATE TABLE IF NOT EXISTS SFDB2.SFS2.POTATOE_LATEST \\( " +
 				"id varchar, recorded integer, deleted boolean, dataset varchar, foo varchar, ok boolean, num integer, baz varchar \\);",
 			).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
 
 			mock.ExpectQuery("COPY INTO SFDB2.SFS2.POTATOE\\(id, recorded, deleted, dataset, foo, ok, num, baz\\) FROM \\( " +
 				"SELECT \\$1:id::varchar, \\d+::integer, coalesce\\(\\$1:deleted::boolean, false\\), 'potatoes'::varchar, " +
@@ -1151,6 +2150,408 @@ func TestWebServer(t *testing.T) {
 				t.Fatalf("unexpected gzip file: \n\n%s. wanted \n\n%s", string(bytes), expected)
 			}
 		})
+		t.Run("PUT entity files in a stage and append only changed entities with change detection", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:       "potatoe",
+					Schema:          "TESTSCHEMA",
+					Database:        "TESTDB",
+					ChangeDetection: true,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://`).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE \\( id varchar, recorded integer," +
+				" deleted boolean, dataset varchar, entity variant, hash varchar \\);").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE ADD COLUMN IF NOT EXISTS hash varchar;").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("INSERT INTO TESTDB.TESTSCHEMA.POTATOE\\(id, recorded, deleted, dataset, entity, hash\\) " +
+				"SELECT src.id, src.recorded, src.deleted, src.dataset, src.entity, src.hash FROM \\( " +
+				"SELECT \\$1:id::varchar as id, \\d+::integer as recorded, coalesce\\(\\$1:deleted::boolean, false\\) as deleted, " +
+				"'potatoe'::varchar as dataset, \\$1::variant as entity, " +
+				"SHA2\\(TO_JSON\\(OBJECT_CONSTRUCT\\('props', \\$1:props, 'refs', \\$1:refs, 'deleted', coalesce\\(\\$1:deleted::boolean, false\\)\\)\\)\\) as hash " +
+				"FROM \\(SELECT \\$1, METADATA\\$FILE_ROW_NUMBER AS ix, METADATA\\$FILE_LAST_MODIFIED AS fts FROM @TESTDB.TESTSCHEMA.S_POTATOE \\(PATTERN => '.*\\(zip.*\\)'\\)\\) " +
+				"QUALIFY ROW_NUMBER\\(\\) OVER \\(PARTITION BY id ORDER BY \\$1:recorded DESC, fts DESC, ix DESC\\) = 1 \\) AS src " +
+				"LEFT JOIN \\(SELECT id, hash FROM TESTDB.TESTSCHEMA.POTATOE QUALIFY ROW_NUMBER\\(\\) OVER \\(PARTITION BY id ORDER BY recorded DESC\\) = 1\\) AS cur " +
+				"ON cur.id = src.id WHERE cur.hash IS NULL OR cur.hash <> src.hash;",
+			).WillReturnRows(sqlmock.NewRows([]string{"number of rows inserted"}).AddRow(1))
+			mock.ExpectCommit()
+
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}},
+{"id": "x:2", "props": {"x:foo": "bar2"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+		})
+		t.Run("should acknowledge replayed batches without loading them again", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			// each request needs its own file, since putEntities closes it
+			testLayer.db.(*testDB).withTmpFiles()
+
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:         "potatoe",
+					Schema:            "TESTSCHEMA",
+					Database:          "TESTDB",
+					IdempotentBatches: true,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			var firstKey, secondKey, expiry, recorded driver.Value
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			// the control table is created once, outside of the load transaction
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES " +
+				"\\(dataset varchar, batch_key varchar, recorded integer\\);").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES WHERE dataset = \\? AND recorded < \\?;").
+				WithArgs("potatoe", captureArg{&expiry}).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			// the key is claimed before the copy, in the same transaction
+			mock.ExpectExec("MERGE INTO TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES AS b "+
+				"USING \\(SELECT \\? AS dataset, \\? AS batch_key\\) AS k ON b.dataset = k.dataset AND b.batch_key = k.batch_key "+
+				"WHEN NOT MATCHED THEN INSERT \\(dataset, batch_key, recorded\\) VALUES \\(k.dataset, k.batch_key, \\?\\);").
+				WithArgs("potatoe", captureArg{&firstKey}, captureArg{&recorded}).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectCommit()
+
+			payload := `[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json", strings.NewReader(payload))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			if recorded.(int64)-expiry.(int64) != defaultBatchKeyTTL.Nanoseconds() {
+				t.Fatalf("expected keys older than %v to expire, got %v and %v", defaultBatchKeyTTL, recorded, expiry)
+			}
+
+			// replay: same content, detected via control table
+			tDB.(*testDB).ExpectConn()
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("MERGE INTO TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES").
+				WithArgs("potatoe", captureArg{&secondKey}, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+
+			res, err = http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json", strings.NewReader(payload))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			if firstKey == nil || firstKey != secondKey {
+				t.Fatalf("expected identical batch keys, got %v and %v", firstKey, secondKey)
+			}
+		})
+		t.Run("should roll back the batch claim when the copy fails", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:         "potatoe",
+					Schema:            "TESTSCHEMA",
+					Database:          "TESTDB",
+					IdempotentBatches: true,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("MERGE INTO TESTDB.TESTSCHEMA.DATALAYER_LOADED_BATCHES").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnError(fmt.Errorf("copy failed"))
+			// no DDL has run since the claim, so the rollback removes the key again and a retry is loaded
+			mock.ExpectRollback()
+
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode == 200 {
+				t.Fatalf("expected failure, got %d", res.StatusCode)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run("should apply table options on create and reconcile them once", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:         "potatoe",
+					Schema:            "TESTSCHEMA",
+					Database:          "TESTDB",
+					LatestTable:       true,
+					ClusterBy:         []any{"recorded"},
+					LatestClusterBy:   "id",
+					Transient:         true,
+					DataRetentionDays: float64(1),
+					TableComment:      "potato's table",
+					TableTags:         map[string]any{"governance.tags.owner": "team"},
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					tDB.(*testDB).ExpectConn()
+				}
+				mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+				mock.ExpectExec("CREATE TRANSIENT TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE \\( id varchar, recorded integer," +
+					" deleted boolean, dataset varchar, entity variant \\) CLUSTER BY \\(recorded\\) DATA_RETENTION_TIME_IN_DAYS = 1 " +
+					"WITH TAG \\(governance.tags.owner = 'team'\\) COMMENT = 'potato''s table';").WillReturnResult(sqlmock.NewResult(1, 1))
+				if i == 0 {
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE CLUSTER BY \\(recorded\\);").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE SET DATA_RETENTION_TIME_IN_DAYS = 1;").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE SET COMMENT = 'potato''s table';").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE SET TAG governance.tags.owner = 'team';").WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectExec("CREATE TRANSIENT TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST \\(.*\\) CLUSTER BY \\(id\\) " +
+					"DATA_RETENTION_TIME_IN_DAYS = 1").WillReturnResult(sqlmock.NewResult(1, 1))
+				if i == 0 {
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE_LATEST CLUSTER BY \\(id\\);").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE_LATEST SET DATA_RETENTION_TIME_IN_DAYS = 1;").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE_LATEST SET COMMENT").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.POTATOE_LATEST SET TAG").WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectBegin()
+				mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+				mock.ExpectQuery("MERGE INTO TESTDB.TESTSCHEMA.POTATOE_LATEST").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+				mock.ExpectCommit()
+
+				res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+					strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+				if err != nil {
+					t.Fatalf("failed to post entities: %v", err)
+				}
+				if res.StatusCode != 200 {
+					t.Fatalf("expected 200, got %d", res.StatusCode)
+				}
+			}
+		})
+		t.Run("should only COPY and ensure a latest view with view strategy", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:      "potatoe",
+					Schema:         "TESTSCHEMA",
+					Database:       "TESTDB",
+					LatestTable:    true,
+					LatestStrategy: LatestStrategyView,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("CREATE VIEW IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST AS SELECT \\* FROM TESTDB.TESTSCHEMA.POTATOE " +
+				"QUALIFY ROW_NUMBER\\(\\) OVER \\(PARTITION BY id ORDER BY recorded DESC\\) = 1;").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.POTATOE").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectCommit()
+
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+		})
+		t.Run("fullsync with dynamic table strategy", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:       "potatoe",
+					Schema:          "TESTSCHEMA",
+					Database:        "TESTDB",
+					LatestTable:     true,
+					LatestStrategy:  LatestStrategyDynamicTable,
+					LatestTargetLag: "5 minutes",
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			mock.ExpectQuery("SHOW STAGES LIKE '%POTATOE_FSID_%'").WillReturnRows(sqlmock.NewRows([]string{}))
+			mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectBegin()
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234 ").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery("COPY INTO TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+			mock.ExpectExec("ALTER STAGE TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234 RENAME TO").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("ALTER TABLE TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234 SWAP WITH POTATOE").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("DROP TABLE TESTDB.TESTSCHEMA.S_POTATOE_FSID_1234").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			// the dynamic table is DDL, so it is created after the swap has been committed
+			mock.ExpectExec("CREATE DYNAMIC TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE_LATEST TARGET_LAG = '5 minutes' WAREHOUSE = testwh " +
+				"AS SELECT \\* FROM TESTDB.TESTSCHEMA.POTATOE QUALIFY ROW_NUMBER\\(\\) OVER \\(PARTITION BY id ORDER BY recorded DESC\\) = 1;").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			req, err := http.NewRequest("POST", "http://localhost:17866/datasets/potatoe/entities",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("universal-data-api-full-sync-start", "true")
+			req.Header.Set("universal-data-api-full-sync-end", "true")
+			req.Header.Set("universal-data-api-full-sync-id", "1234")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+		})
+		t.Run("should only PUT and queue the files in pipe ingest mode", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			testLayer.db.(*testDB).withTmpFiles()
+			var queued []string
+			pipeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/data/pipes/TESTDB.TESTSCHEMA.P_POTATOE/insertFiles" || r.URL.Query().Get("requestId") == "" ||
+					!strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") ||
+					r.Header.Get("X-Snowflake-Authorization-Token-Type") != "KEYPAIR_JWT" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				var body struct {
+					Files []struct {
+						Path string `json:"path"`
+					} `json:"files"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				for _, f := range body.Files {
+					queued = append(queued, f.Path)
+				}
+				w.Write([]byte(`{"responseCode":"SUCCESS"}`))
+			}))
+			defer pipeAPI.Close()
+			testLayer.db.(*testDB).sfDB.pipes.baseURL = pipeAPI.URL
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:  "potatoe",
+					Schema:     "TESTSCHEMA",
+					Database:   "TESTDB",
+					IngestMode: IngestModePipe,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					tDB.(*testDB).ExpectConn()
+				}
+				// pipe files have their own stage, so that copy mode files are never ingested by the pipe
+				mock.ExpectExec(`CREATE STAGE IF NOT EXISTS TESTDB.TESTSCHEMA.S_POTATOE_PIPE`).WillReturnResult(sqlmock.NewResult(1, 1))
+				if i == 0 {
+					mock.ExpectExec("CREATE TABLE IF NOT EXISTS TESTDB.TESTSCHEMA.POTATOE ").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("CREATE PIPE IF NOT EXISTS TESTDB.TESTSCHEMA.P_POTATOE AS COPY INTO TESTDB.TESTSCHEMA.POTATOE\\(id, recorded, deleted, dataset, entity\\) " +
+						"FROM \\( SELECT \\$1:id::varchar, DATE_PART\\(epoch_nanosecond, METADATA\\$FILE_LAST_MODIFIED\\)::integer, .* 'potatoe'::varchar, .* FROM @TESTDB.TESTSCHEMA.S_POTATOE_PIPE\\)").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectQuery(`PUT file://.*zip`).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("OK"))
+				mock.ExpectQuery("SELECT SYSTEM\\$PIPE_STATUS\\('TESTDB.TESTSCHEMA.P_POTATOE'\\);").WillReturnRows(
+					sqlmock.NewRows([]string{"status"}).AddRow(`{"executionState":"RUNNING","pendingFileCount":1,"oldestFileTimestamp":"2024-01-01T00:00:00.000Z"}`))
+
+				res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+					strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+				if err != nil {
+					t.Fatalf("failed to post entities: %v", err)
+				}
+				if res.StatusCode != 200 {
+					t.Fatalf("expected 200, got %d", res.StatusCode)
+				}
+				if len(queued) != i+1 || !strings.HasPrefix(queued[i], "zip") {
+					t.Fatalf("expected uploaded file to be queued, got %v", queued)
+				}
+			}
+		})
+		t.Run("should reject pipe ingest mode with a merged latest table", func(t *testing.T) {
+			setup()
+			t.Cleanup(cleanup)
+			cfg.DatasetDefinitions = []*common_datalayer.DatasetDefinition{{
+				DatasetName: "potatoe",
+				SourceConfig: map[string]any{
+					TableName:   "potatoe",
+					Schema:      "TESTSCHEMA",
+					Database:    "TESTDB",
+					LatestTable: true,
+					IngestMode:  IngestModePipe,
+				},
+			}}
+			testLayer.UpdateConfiguration(cfg)
+
+			res, err := http.Post("http://localhost:17866/datasets/potatoe/entities", "application/json",
+				strings.NewReader(`[{"id": "@context", "namespaces": {"x": "http://snowflake/foo/"}},
+{"id": "x:1", "props": {"x:foo": "bar"}, "refs": {}}]
+`))
+			if err != nil {
+				t.Fatalf("failed to post entities: %v", err)
+			}
+			if res.StatusCode == 200 {
+				t.Fatalf("expected pipe mode with latest table merge to be rejected")
+			}
+		})
 		t.Run("fullsync without LATEST_ACTIVE", func(t *testing.T) {
 			setup()
 			t.Cleanup(cleanup)
@@ -1471,3 +2872,13 @@ func TestWebServer(t *testing.T) {
 		})
 	})
 }
+
+// captureArg is a sqlmock argument matcher that records the matched value
+type captureArg struct {
+	v *driver.Value
+}
+
+func (a captureArg) Match(v driver.Value) bool {
+	*a.v = v
+	return true
+}
@@ -16,30 +16,72 @@ package layer
 
 import (
 	"fmt"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 )
 
-var defaultMemoryHeadroom = 500 * 1000 * 1000
+var (
+	defaultMemoryHeadroom   = 500 // MB
+	defaultMemoryRetryAfter = 30 * time.Second
+	// writers check the memory headroom every memoryCheckInterval buffered entities
+	memoryCheckInterval int64 = 1000
+)
+
+// memoryStats reads the memory stats of the process, replaceable in tests
+var memoryStats = ReadMemoryStats
+
+// memoryGuard rejects requests and in-flight writes when the layer runs low on memory.
+// A nil memoryGuard accepts everything.
+type memoryGuard struct {
+	config  *common.Config
+	logger  common.Logger
+	metrics common.Metrics
+}
 
-func (dl *SnowflakeDataLayer) assertMemory() common.LayerError {
-	minHeadRoom := defaultMemoryHeadroom
-	if confHeadRoomAny, ok := dl.config.NativeSystemConfig[MemoryHeadroom]; ok {
-		if confHeadRoom, ok := confHeadRoomAny.(int); ok && confHeadRoom > 0 {
-			minHeadRoom = confHeadRoom * 1000 * 1000
-		}
+func (dl *SnowflakeDataLayer) memoryGuard() *memoryGuard {
+	return &memoryGuard{config: dl.config, logger: dl.logger, metrics: dl.metrics}
+}
+
+func (dl *SnowflakeDataLayer) assertMemory(dataset string) common.LayerError {
+	return dl.memoryGuard().assert("request", dataset)
+}
+
+// headroom returns the free memory of the layer and the configured minimum, in bytes.
+// known is false when no memory stats are available.
+func (g *memoryGuard) headroom() (headroom int, minHeadRoom int, known bool) {
+	minHeadRoom = confInt(g.config, MemoryHeadroom) * 1000 * 1000
+
+	mem := memoryStats()
+	if mem.Max <= 0 {
+		return 0, minHeadRoom, false
 	}
+	return int(mem.Max - mem.Current), minHeadRoom, true
+}
 
-	mem := ReadMemoryStats()
-	if mem.Max > 0 {
-		headroom := int(mem.Max - mem.Current)
-		dl.logger.Debug(fmt.Sprintf("MemoryGuard: headroom: %v (min: %v)", headroom, minHeadRoom))
-		if headroom < minHeadRoom {
-			dl.logger.Warn("MemoryGuard: headroom too low, rejecting request")
-			return ErrHeadroom
-		}
-	} else {
-		dl.logger.Debug("MemoryGuard: no memory stats available")
+// assert returns a RetryableError wrapping ErrHeadroom when the headroom is too low.
+// stage is "request" when a dataset is resolved, and "write" for buffered entities of a running write.
+// Rejections are counted in the metric snowflake.memory_guard.rejected, with the stage as operation tag.
+func (g *memoryGuard) assert(stage string, dataset string) common.LayerError {
+	if g == nil {
+		return nil
+	}
+	headroom, minHeadRoom, known := g.headroom()
+	if !known {
+		g.logger.Debug("MemoryGuard: no memory stats available")
+		return nil
+	}
+	g.logger.Debug(fmt.Sprintf("MemoryGuard: headroom: %v (min: %v)", headroom, minHeadRoom))
+	if headroom >= minHeadRoom {
+		return nil
+	}
+	retryAfter := confDuration(g.config, MemoryRetryAfter)
+	// POST responses of the web service do not carry the error message, so the back-off hint is logged
+	g.logger.Warn("MemoryGuard: headroom too low, rejecting "+stage, "dataset", dataset,
+		"headroom", headroom, "min", minHeadRoom, "retry_after", retryAfter.String())
+	tags := []string{"dataset:" + dataset, "operation:" + stage}
+	if err := g.metrics.Incr("snowflake.memory_guard.rejected", tags, 1); err != nil {
+		g.logger.Warn("Error with metrics", "error", err.Error())
 	}
-	return nil
+	return retryable(ErrHeadroom, retryAfter)
 }
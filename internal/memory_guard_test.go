@@ -0,0 +1,89 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	conf, metrics, logger := testDeps()
+	conf.NativeSystemConfig[MemoryHeadroom] = 100
+	conf.NativeSystemConfig[MemoryRetryAfter] = "45s"
+	dl := &SnowflakeDataLayer{config: conf, logger: logger, metrics: metrics}
+	t.Cleanup(func() { memoryStats = ReadMemoryStats })
+	lowMemory := func() Memory { return Memory{Current: 950 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+	enoughMemory := func() Memory { return Memory{Current: 100 * 1000 * 1000, Max: 1000 * 1000 * 1000} }
+
+	t.Run("should reject requests with a retryable error", func(t *testing.T) {
+		memoryStats = lowMemory
+		_, err := dl.Dataset("people")
+		if err == nil {
+			t.Fatal("expected rejection")
+		}
+		if !errors.Is(err.Underlying(), ErrRetryable) || !errors.Is(err.Underlying(), ErrHeadroom) {
+			t.Fatalf("expected retryable headroom error, got %v", err)
+		}
+		var retryErr *RetryableError
+		if !errors.As(err.Underlying(), &retryErr) || retryErr.RetryAfter.String() != "45s" {
+			t.Fatalf("expected retry after 45s, got %v", err)
+		}
+		if !strings.HasSuffix(err.Error(), "retry after 45s") {
+			t.Fatalf("expected back-off hint in message, got %s", err.Error())
+		}
+		if metrics.(*testMetrics).metrics["snowflake.memory_guard.rejected"] != 1 {
+			t.Fatalf("expected one counted rejection, got %v", metrics.(*testMetrics).metrics)
+		}
+	})
+
+	t.Run("should reject in-flight writes", func(t *testing.T) {
+		memoryStats = enoughMemory
+		ds, err := dl.Dataset("people")
+		if err != nil {
+			t.Fatal(err)
+		}
+		released := 0
+		w := &batchWriter{dataset: ds.(*Dataset), release: func() { released++ }, batchSize: 50000}
+		for i := int64(0); i < memoryCheckInterval; i++ {
+			if err := w.Write(&egdm.Entity{ID: "a"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		memoryStats = lowMemory
+		for i := int64(1); i < memoryCheckInterval; i++ {
+			if err := w.Write(&egdm.Entity{ID: "a"}); err != nil {
+				t.Fatalf("expected memory to be checked every %d entities, got %v", memoryCheckInterval, err)
+			}
+		}
+		err = w.Write(&egdm.Entity{ID: "a"})
+		if err == nil || !errors.Is(err.Underlying(), ErrRetryable) {
+			t.Fatalf("expected retryable error, got %v", err)
+		}
+		if released != 1 {
+			t.Fatalf("expected connection to be released, got %d", released)
+		}
+		w.release()
+		if released != 1 {
+			t.Fatalf("expected connection to be released only once, got %d", released)
+		}
+		if metrics.(*testMetrics).metrics["snowflake.memory_guard.rejected"] != 2 {
+			t.Fatalf("expected two counted rejections, got %v", metrics.(*testMetrics).metrics)
+		}
+	})
+}
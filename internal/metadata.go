@@ -0,0 +1,139 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// tableStats holds the facts about a dataset table that snowflake reports in its metadata views
+type tableStats struct {
+	columns []map[string]string
+	// row counts are nil when the table does not exist or is a view
+	rowCount       *int64
+	latestRowCount *int64
+}
+
+// MetaData implements common.Dataset.
+// In addition to loadMetaData, it reports the columns and row counts of the resolved table.
+// The common-datalayer web service does not call it, the health server serves it, see handleMetaData.
+func (ds *Dataset) MetaData() map[string]any {
+	md := ds.loadMetaData(time.Now())
+	// query datasets read no table of their own
+	if stmt, _ := customQuery(ds.datasetDefinition); stmt != "" {
+		return md
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stats, err := ds.db.tableStats(ctx, ds.datasetDefinition)
+	if err != nil {
+		ds.logger.Warn("Failed to read table metadata", "dataset", ds.name, "error", err)
+		md["metadata_error"] = err.Error()
+		return md
+	}
+	md["columns"] = stats.columns
+	if stats.rowCount != nil {
+		md["row_count"] = *stats.rowCount
+	}
+	if stats.latestRowCount != nil {
+		md["latest_row_count"] = *stats.latestRowCount
+	}
+	return md
+}
+
+// loadMetaData returns the metadata that needs no snowflake query: the source config without secret values,
+// the load state of the dataset in this process, and the resolved table. It is listed in DatasetDescriptions.
+func (ds *Dataset) loadMetaData(now time.Time) map[string]any {
+	md := map[string]any{}
+	for k, v := range ds.sourceConfig {
+		if isSecretKey(k) {
+			continue
+		}
+		md[k] = v
+	}
+	state := ds.state.snapshot()
+	md["full_sync_in_progress"] = state.fullSyncInProgress(now, ds.fullSyncTimeout)
+	if !state.lastIncremental.IsZero() {
+		md["last_incremental_load"] = state.lastIncremental.UTC().Format(time.RFC3339)
+	}
+	if !state.lastFullSync.IsZero() {
+		md["last_full_sync"] = state.lastFullSync.UTC().Format(time.RFC3339)
+	}
+
+	if stmt, _ := customQuery(ds.datasetDefinition); stmt != "" {
+		return md
+	}
+	dbName, schemaName, table := ds.db.tableParts(ds.datasetDefinition)
+	md["resolved_database"] = dbName
+	md["resolved_schema"] = schemaName
+	md["resolved_table"] = table
+	return md
+}
+
+// tableStats reads the columns and row counts of the dataset table and its latest table
+// from INFORMATION_SCHEMA.
+func (sf *SfDB) tableStats(ctx context.Context, datasetDefinition *common.DatasetDefinition) (*tableStats, error) {
+	dbName, schemaName, table := sf.tableParts(datasetDefinition)
+	stats := &tableStats{columns: []map[string]string{}}
+
+	rows, err := sf.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT COLUMN_NAME, DATA_TYPE FROM %s.INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION;",
+		dbName), schemaName, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		stats.columns = append(stats.columns, map[string]string{"name": name, "type": dataType})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	countRows, err := sf.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT TABLE_NAME, ROW_COUNT FROM %s.INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME IN (?, ?);",
+		dbName), schemaName, table, table+"_LATEST")
+	if err != nil {
+		return nil, err
+	}
+	defer countRows.Close()
+	for countRows.Next() {
+		var name string
+		var cnt sql.NullInt64
+		if err := countRows.Scan(&name, &cnt); err != nil {
+			return nil, err
+		}
+		if !cnt.Valid {
+			continue
+		}
+		n := cnt.Int64
+		if name == table {
+			stats.rowCount = &n
+		} else {
+			stats.latestRowCount = &n
+		}
+	}
+	return stats, countRows.Err()
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// opMetrics emits the metrics of one snowflake operation, tagged with dataset and operation.
+// Metric names are snowflake.<operation>.<name>. Failures to emit are only logged.
+type opMetrics struct {
+	metrics   common.Metrics
+	logger    common.Logger
+	operation string
+	tags      []string
+}
+
+func newOpMetrics(metrics common.Metrics, logger common.Logger, dataset string, operation string) *opMetrics {
+	return &opMetrics{
+		metrics:   metrics,
+		logger:    logger,
+		operation: operation,
+		tags:      []string{"dataset:" + dataset, "operation:" + operation},
+	}
+}
+
+func (sf *SfDB) op(dataset string, operation string) *opMetrics {
+	return newOpMetrics(sf.metrics, sf.logger, dataset, operation)
+}
+
+func (m *opMetrics) name(name string) string {
+	return "snowflake." + m.operation + "." + name
+}
+
+func (m *opMetrics) timing(name string, start time.Time) {
+	if err := m.metrics.Timing(m.name(name), time.Since(start), m.tags, 1); err != nil {
+		m.logger.Warn("Error with metrics", "error", err.Error())
+	}
+}
+
+func (m *opMetrics) gauge(name string, value float64) {
+	if err := m.metrics.Gauge(m.name(name), value, m.tags, 1); err != nil {
+		m.logger.Warn("Error with metrics", "error", err.Error())
+	}
+}
+
+func (m *opMetrics) incr(name string) {
+	if err := m.metrics.Incr(m.name(name), m.tags, 1); err != nil {
+		m.logger.Warn("Error with metrics", "error", err.Error())
+	}
+}
+
+// queryCounts runs a statement that reports row counts, like COPY INTO, MERGE or INSERT.
+// Numeric result columns are summed up by lower case column name, e.g. "rows_loaded"
+// for COPY INTO (one row per file), or "number of rows inserted" for MERGE.
+func (sf *SfDB) queryCounts(ctx context.Context, tx *sql.Tx, q string) (map[string]int64, error) {
+	rows, err := sf.query(ctx, tx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	vals := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, col := range cols {
+			if n, err := strconv.ParseInt(vals[i].String, 10, 64); err == nil {
+				counts[strings.ToLower(col)] += n
+			}
+		}
+	}
+	return counts, rows.Err()
+}
+
+// result columns of counted statements, mapped to metric names
+var (
+	copyCounts   = map[string]string{"rows_loaded": "rows_loaded"}
+	mergeCounts  = map[string]string{"number of rows inserted": "rows_inserted", "number of rows updated": "rows_updated"}
+	insertCounts = map[string]string{"number of rows inserted": "rows_inserted"}
+)
+
+// runCounted runs a statement with queryCounts, and reports its duration and the given counts.
+// Failed statements are counted as snowflake.<operation>.errors.
+// The statement is traced as span snowflake.<operation>, with the counts as attributes.
+func (sf *SfDB) runCounted(ctx context.Context, tx *sql.Tx, q string, dataset string, operation string, counts map[string]string) error {
+	m := sf.op(dataset, operation)
+	ctx, span := startSpan(ctx, "snowflake."+operation, dataset)
+	start := time.Now()
+	res, err := sf.queryCounts(ctx, tx, q)
+	if err != nil {
+		m.incr("errors")
+		endSpan(span, err)
+		return err
+	}
+	m.timing("duration", start)
+	for col, name := range counts {
+		m.gauge(name, float64(res[col]))
+		span.SetAttributes(attribute.Int64(name, res[col]))
+	}
+	endSpan(span, nil)
+	return nil
+}
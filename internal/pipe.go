@@ -0,0 +1,278 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pipeStatus holds the parts of SYSTEM$PIPE_STATUS the layer reports on
+type pipeStatus struct {
+	ExecutionState      string     `json:"executionState"`
+	PendingFileCount    int        `json:"pendingFileCount"`
+	OldestFileTimestamp *time.Time `json:"oldestFileTimestamp"`
+	LastIngestedAt      *time.Time `json:"lastIngestedTimestamp"`
+}
+
+// lag is the age of the oldest file that is still waiting for ingestion.
+func (s *pipeStatus) lag(now time.Time) time.Duration {
+	if s.PendingFileCount == 0 || s.OldestFileTimestamp == nil {
+		return 0
+	}
+	return now.Sub(*s.OldestFileTimestamp)
+}
+
+func (sf *SfDB) pipeName(datasetDefinition *common.DatasetDefinition) string {
+	dbName, schemaName, dsName := sf.tableParts(datasetDefinition)
+	return fmt.Sprintf("%s.%s.P_%s", dbName, schemaName, dsName)
+}
+
+// pipeStage is the stage of the pipe. It is separate from the stage of copy mode, S_<table>, so that
+// a pipe never sees files that were uploaded for a COPY INTO.
+func (sf *SfDB) pipeStage(datasetDefinition *common.DatasetDefinition) string {
+	dbName, schemaName, dsName := sf.tableParts(datasetDefinition)
+	return fmt.Sprintf("%s.%s.S_%s_PIPE", dbName, schemaName, dsName)
+}
+
+// mkPipe ensures the pipe stage, the dataset table and a pipe that copies files from the pipe stage into it.
+// It returns the pipe and its stage. The table and pipe are created once per process. An existing pipe is
+// never replaced, since that would reset its load history.
+func (sf *SfDB) mkPipe(ctx context.Context, datasetDefinition *common.DatasetDefinition) (string, string, error) {
+	if _, err := sf.ingestMode(datasetDefinition); err != nil {
+		return "", "", err
+	}
+	opts, err := tableOptionsOf(datasetDefinition)
+	if err != nil {
+		return "", "", err
+	}
+	stage := sf.pipeStage(datasetDefinition)
+	if err := sf.createStage(ctx, stage); err != nil {
+		return "", "", err
+	}
+	dbName, schemaName, dsName := sf.tableParts(datasetDefinition)
+	table := fmt.Sprintf("%s.%s.%s", dbName, schemaName, dsName)
+	pipe := sf.pipeName(datasetDefinition)
+	colNames, columns, colExtractions, _, _ := ColMappings(datasetDefinition)
+
+	// the pipe definition is static, so the recorded timestamp is taken from the upload time of each file
+	pipeStmt := fmt.Sprintf(`
+	CREATE PIPE IF NOT EXISTS %s AS
+	COPY INTO %s(id, recorded, deleted, dataset, %s)
+	    FROM (
+	    	SELECT
+ 			$1:id::varchar,
+			DATE_PART(epoch_nanosecond, METADATA$FILE_LAST_MODIFIED)::integer,
+ 			coalesce($1:deleted::boolean, false),
+			'%s'::varchar,
+			%s
+	    	FROM @%s)
+	FILE_FORMAT = (TYPE='json' COMPRESSION=GZIP);
+	`, pipe, table, colNames, datasetDefinition.DatasetName, colExtractions, stage)
+	if _, done := sf.reconciledTables.Load(pipeStmt); done {
+		return pipe, stage, nil
+	}
+
+	// the statements are DDL, which snowflake commits one by one
+	conn := ctx.Value(Connection).(*sql.Conn)
+	if _, err := sf.exec(ctx, conn, fmt.Sprintf(`
+	CREATE %sTABLE IF NOT EXISTS %s ( id varchar, recorded integer, deleted boolean, dataset varchar, %s )%s;
+	`, opts.kind(), table, columns, opts.createClause(false))); err != nil {
+		return "", "", err
+	}
+	if err := sf.reconcileTableOptions(ctx, conn, table, opts, false); err != nil {
+		return "", "", err
+	}
+	if sf.hasLatestView(datasetDefinition) {
+		if err := sf.ensureLatestView(ctx, conn, table, datasetDefinition); err != nil {
+			return "", "", err
+		}
+	}
+	sf.logger.Debug(pipeStmt)
+	if _, err := sf.exec(ctx, conn, pipeStmt); err != nil {
+		return "", "", err
+	}
+	sf.reconciledTables.Store(pipeStmt, true)
+	return pipe, stage, nil
+}
+
+// ingestFiles queues the uploaded files with the snowpipe REST API, and reports the ingestion lag.
+// Snowflake loads the files asynchronously, and skips files that the pipe has loaded before.
+func (sf *SfDB) ingestFiles(ctx context.Context, pipe string, files []string, datasetDefinition *common.DatasetDefinition) error {
+	ctx, span := startSpan(ctx, "snowflake.ingest", datasetDefinition.DatasetName, attribute.Int("files", len(files)))
+	sf.logger.Debug(fmt.Sprintf("Queueing '%s' in pipe %s", strings.Join(files, "', '"), pipe))
+	if err := sf.pipes.insertFiles(ctx, pipe, files); err != nil {
+		endSpan(span, err)
+		return err
+	}
+	endSpan(span, nil)
+	sf.reportPipeStatus(ctx, pipe, datasetDefinition.DatasetName)
+	return nil
+}
+
+func (sf *SfDB) pipeStatus(ctx context.Context, pipe string) (*pipeStatus, error) {
+	conn := ctx.Value(Connection).(*sql.Conn)
+	var res string
+	if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT SYSTEM$PIPE_STATUS('%s');", pipe)).Scan(&res); err != nil {
+		return nil, err
+	}
+	status := &pipeStatus{}
+	if err := json.Unmarshal([]byte(res), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// reportPipeStatus emits the pending file count and the ingestion lag of a pipe as gauges.
+// Failures are only logged, the files are already queued at this point.
+func (sf *SfDB) reportPipeStatus(ctx context.Context, pipe string, datasetName string) {
+	status, err := sf.pipeStatus(ctx, pipe)
+	if err != nil {
+		sf.logger.Warn("Failed to read pipe status", "pipe", pipe, "error", err)
+		return
+	}
+	if status.ExecutionState != "RUNNING" {
+		sf.logger.Warn("Pipe is not running", "pipe", pipe, "state", status.ExecutionState)
+	}
+	tags := []string{"dataset:" + datasetName, "operation:ingest"}
+	if err := sf.metrics.Gauge("snowflake.pipe.pending_files", float64(status.PendingFileCount), tags, 1); err != nil {
+		sf.logger.Warn("Error with metrics", "error", err.Error())
+	}
+	if err := sf.metrics.Gauge("snowflake.pipe.lag", status.lag(time.Now()).Seconds(), tags, 1); err != nil {
+		sf.logger.Warn("Error with metrics", "error", err.Error())
+	}
+}
+
+// pipeClient calls the snowpipe REST API. It authenticates with a key pair JWT of the layer user.
+type pipeClient struct {
+	// scheme, host and port of the snowflake account
+	baseURL string
+	account string
+	user    string
+	key     *rsa.PrivateKey
+	http    *http.Client
+}
+
+func newPipeClient(baseURL string, account string, user string, key *rsa.PrivateKey) *pipeClient {
+	// the JWT names the account without region or cloud, e.g. XY12345 for xy12345.eu-west-1
+	account, _, _ = strings.Cut(account, ".")
+	return &pipeClient{
+		baseURL: baseURL,
+		account: strings.ToUpper(account),
+		user:    strings.ToUpper(user),
+		key:     key,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// insertFiles queues files in a pipe. The file names are relative to the stage of the pipe.
+func (c *pipeClient) insertFiles(ctx context.Context, pipe string, files []string) error {
+	type file struct {
+		Path string `json:"path"`
+	}
+	body := struct {
+		Files []file `json:"files"`
+	}{}
+	for _, f := range files {
+		body.Files = append(body.Files, file{Path: f})
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	token, err := c.token(time.Now())
+	if err != nil {
+		return err
+	}
+	requestID, err := newRequestID()
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/v1/data/pipes/%s/insertFiles?requestId=%s", c.baseURL, url.PathEscape(pipe), requestID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to queue files in pipe %s: %w", pipe, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("failed to queue files in pipe %s, request %s: %s %s", pipe, requestID, res.Status, msg)
+	}
+	return nil
+}
+
+// token creates a key pair JWT, as described in the snowflake key pair authentication documentation
+func (c *pipeClient) token(now time.Time) (string, error) {
+	pub, err := x509.MarshalPKIXPublicKey(&c.key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := sha256.Sum256(pub)
+	qualifiedUser := c.account + "." + c.user
+	claims, err := json.Marshal(map[string]any{
+		"iss": qualifiedUser + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		"sub": qualifiedUser,
+		"iat": now.Unix(),
+		// snowflake accepts tokens that are valid for at most one hour
+		"exp": now.Add(59 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// newRequestID returns a random UUID, which snowflake reports with the load history of the files
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReportPipeStatus(t *testing.T) {
+	conf, metrics, logger := testDeps()
+	tDB, err := newTestDB(1000, conf, logger, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tDB.newConnection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), Connection, conn)
+	// consume the session setup expected by newTestDB
+	tDB.consumeSession()
+
+	oldest := time.Now().Add(-90 * time.Second).UTC().Format(time.RFC3339)
+	tDB.mock.ExpectQuery("SELECT SYSTEM\\$PIPE_STATUS\\('DB.SCHEMA.P_DS'\\);").WillReturnRows(
+		sqlmock.NewRows([]string{"status"}).
+			AddRow(`{"executionState":"RUNNING","pendingFileCount":3,"oldestFileTimestamp":"` + oldest + `"}`))
+	tDB.sfDB.reportPipeStatus(ctx, "DB.SCHEMA.P_DS", "ds")
+
+	m := metrics.(*testMetrics).metrics
+	if m["snowflake.pipe.pending_files"] != float64(3) {
+		t.Fatalf("expected 3 pending files, got %v", m["snowflake.pipe.pending_files"])
+	}
+	if lag := m["snowflake.pipe.lag"].(float64); lag < 89 || lag > 120 {
+		t.Fatalf("expected lag of about 90 seconds, got %v", lag)
+	}
+
+	// no pending files means no lag
+	tDB.mock.ExpectQuery("SELECT SYSTEM\\$PIPE_STATUS").WillReturnRows(
+		sqlmock.NewRows([]string{"status"}).
+			AddRow(`{"executionState":"RUNNING","pendingFileCount":0,"oldestFileTimestamp":"` + oldest + `"}`))
+	tDB.sfDB.reportPipeStatus(ctx, "DB.SCHEMA.P_DS", "ds")
+	if m["snowflake.pipe.lag"] != float64(0) {
+		t.Fatalf("expected no lag, got %v", m["snowflake.pipe.lag"])
+	}
+	if err := tDB.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipeClient(t *testing.T) {
+	conf, _, _ := testDeps()
+	key, err := privateKey(context.Background(), conf, FileSecretProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newPipeClient("", "xy12345.eu-west-1", "layer_user", key)
+
+	t.Run("should sign a key pair jwt for the account and user", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		token, err := c.token(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			t.Fatalf("expected 3 token parts, got %d", len(parts))
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatalf("invalid signature: %v", err)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]any
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["sub"] != "XY12345.LAYER_USER" || !strings.HasPrefix(claims["iss"].(string), "XY12345.LAYER_USER.SHA256:") {
+			t.Fatalf("unexpected claims %v", claims)
+		}
+		if claims["exp"].(float64)-claims["iat"].(float64) > 3600 {
+			t.Fatalf("token valid for more than one hour: %v", claims)
+		}
+	})
+	t.Run("should report failed requests", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Specified object does not exist or not authorized. Pipe not found"}`))
+		}))
+		defer srv.Close()
+		c.baseURL = srv.URL
+		err := c.insertFiles(context.Background(), "DB.SCHEMA.P_DS", []string{"zip123"})
+		if err == nil || !strings.HasPrefix(err.Error(), "failed to queue files in pipe DB.SCHEMA.P_DS, request ") ||
+			!strings.Contains(err.Error(), "404 Not Found") || !strings.Contains(err.Error(), "Pipe not found") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PreflightOff    = "off"
+	PreflightWarn   = "warn"
+	PreflightStrict = "strict"
+)
+
+// probeResult is the outcome of one preflight probe statement
+type probeResult struct {
+	Name      string `json:"name"`
+	Statement string `json:"statement"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	Duration  string `json:"duration"`
+}
+
+// preflightReport holds the results of the last preflight run
+type preflightReport struct {
+	Time   time.Time      `json:"time"`
+	OK     bool           `json:"ok"`
+	Probes []*probeResult `json:"probes"`
+}
+
+// preflightState keeps the last report, and makes sure only one run is active at a time
+type preflightState struct {
+	run    sync.Mutex
+	mu     sync.Mutex
+	report *preflightReport
+}
+
+func (p *preflightState) last() *preflightReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.report
+}
+
+func (p *preflightState) set(report *preflightReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report = report
+}
+
+// startupPreflight runs the preflight checks when the layer starts, unless they are turned off.
+// In strict mode, failed checks are returned as error, so that the layer does not start.
+func (dl *SnowflakeDataLayer) startupPreflight() error {
+	mode := confString(dl.config, PreflightMode)
+	if mode == PreflightOff {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	report := dl.preflight(ctx)
+	if !report.OK && mode == PreflightStrict {
+		var failed []string
+		for _, p := range report.Probes {
+			if !p.OK {
+				failed = append(failed, fmt.Sprintf("%s: %s", p.Name, p.Error))
+			}
+		}
+		return fmt.Errorf("preflight checks failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// preflight verifies that the layer can use its warehouse, database and schema, that it may create
+// stages and tables, and that it can read every configured read table. All probes run in one session,
+// set up like the sessions used for requests. Probes that create objects only create temporary ones.
+func (dl *SnowflakeDataLayer) preflight(ctx context.Context) *preflightReport {
+	dl.preflightState.run.Lock()
+	defer dl.preflightState.run.Unlock()
+
+	report := &preflightReport{Time: time.Now(), OK: true}
+	probe := func(name, stmt string, run func() error) bool {
+		start := time.Now()
+		err := run()
+		res := &probeResult{Name: name, Statement: stmt, OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			res.Error = err.Error()
+			report.OK = false
+			dl.logger.Warn("Preflight probe failed", "probe", name, "statement", stmt, "error", err)
+		} else {
+			dl.logger.Debug("Preflight probe succeeded", "probe", name, "statement", stmt)
+		}
+		report.Probes = append(report.Probes, res)
+		return err == nil
+	}
+
+	conn, err := dl.db.newConnection(ctx)
+	if err == nil {
+		defer conn.Close()
+	}
+	if !probe("connection", "", func() error {
+		if err != nil {
+			return err
+		}
+		return initSession(ctx, conn, newQueryTag(dl.serviceName(), "", OperationPreflight))
+	}) {
+		dl.preflightState.set(report)
+		return report
+	}
+	exec := func(name, stmt string) bool {
+		return probe(name, stmt, func() error {
+			_, err := conn.ExecContext(ctx, stmt)
+			return err
+		})
+	}
+
+	warehouse := strings.ToUpper(confString(dl.config, SnowflakeWarehouse))
+	nameSpace := strings.ToUpper(confString(dl.config, SnowflakeDB) + "." + confString(dl.config, SnowflakeSchema))
+	exec("warehouse usage", fmt.Sprintf("USE WAREHOUSE %s;", warehouse))
+	// a read only layer does not need to create objects
+	if exec("schema usage", fmt.Sprintf("USE SCHEMA %s;", nameSpace)) && confString(dl.config, LayerMode) != LayerModeRead {
+		exec("create stage", fmt.Sprintf("CREATE TEMPORARY STAGE %s.DATALAYER_PREFLIGHT;", nameSpace))
+		exec("create table", fmt.Sprintf("CREATE TEMPORARY TABLE %s.DATALAYER_PREFLIGHT (id varchar);", nameSpace))
+		// temporary objects disappear with the session, but we clean up right away
+		_, _ = conn.ExecContext(ctx, fmt.Sprintf("DROP STAGE IF EXISTS %s.DATALAYER_PREFLIGHT;", nameSpace))
+		_, _ = conn.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s.DATALAYER_PREFLIGHT;", nameSpace))
+	}
+	registry := dl.registry()
+	for _, name := range registry.names() {
+		ds, _ := registry.get(name)
+		// queries are compiled when the configuration is loaded
+		if stmt, _ := customQuery(ds.datasetDefinition); !isReadDataset(ds) || ds.access.readDenied || stmt != "" {
+			continue
+		}
+		dbName, schemaName, table := dl.db.tableParts(ds.datasetDefinition)
+		exec("select "+name, fmt.Sprintf("SELECT 1 FROM %s.%s.%s LIMIT 0;", dbName, schemaName, table))
+	}
+
+	dl.preflightState.set(report)
+	if report.OK {
+		dl.logger.Info("Preflight checks succeeded")
+	} else {
+		dl.logger.Warn("Preflight checks failed, see probe results")
+	}
+	return report
+}
+
+// isReadDataset reports whether a configured dataset is meant for reading,
+// i.e. it has an outgoing mapping or a raw entity column
+func isReadDataset(ds *Dataset) bool {
+	if ds.datasetDefinition.OutgoingMappingConfig != nil {
+		return true
+	}
+	rawColumn, _ := ds.sourceConfig[RawColumn].(string)
+	return rawColumn != ""
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+	gsf "github.com/snowflakedb/gosnowflake"
+)
+
+// operations in query tags
+const (
+	OperationRead        = "read"
+	OperationIncremental = "incremental"
+	OperationFullSync    = "fullsync"
+	OperationPreflight   = "preflight"
+	OperationExplain     = "explain"
+)
+
+// queryTag is set as QUERY_TAG on every layer session, so that the statements of a request
+// can be found in snowflake QUERY_HISTORY
+type queryTag struct {
+	Service   string `json:"service"`
+	Dataset   string `json:"dataset,omitempty"`
+	Operation string `json:"operation"`
+	// LayerRequestID is generated by the layer for each session. It is not the id of the http request,
+	// which common-datalayer does not pass to the layer
+	LayerRequestID string `json:"layer_request_id"`
+}
+
+func newQueryTag(service string, dataset string, operation string) *queryTag {
+	return &queryTag{Service: service, Dataset: dataset, Operation: operation, LayerRequestID: gsf.NewUUID().String()}
+}
+
+// sql returns the tag as snowflake string literal
+func (t *queryTag) sql() string {
+	b, _ := json.Marshal(t)
+	// backslashes are escape characters in snowflake string literals
+	return sqlString(strings.ReplaceAll(string(b), `\`, `\\`))
+}
+
+// logArgs returns the tag as logger arguments
+func (t *queryTag) logArgs() []any {
+	if t == nil {
+		return nil
+	}
+	return []any{"dataset", t.Dataset, "operation", t.Operation, "layer_request_id", t.LayerRequestID}
+}
+
+func queryTagOf(ctx context.Context) *queryTag {
+	t, _ := ctx.Value(QueryTag).(*queryTag)
+	return t
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// exec runs a statement on a connection or transaction, and logs failures with the snowflake query id
+func (sf *SfDB) exec(ctx context.Context, e execer, stmt string, args ...any) (sql.Result, error) {
+	qctx, queryID := withQueryID(ctx)
+	res, err := e.ExecContext(qctx, stmt, args...)
+	if err != nil {
+		logStatementError(sf.logger, ctx, stmt, queryID(err), err)
+	}
+	return res, err
+}
+
+// query runs a query on a connection or transaction, and logs failures with the snowflake query id
+func (sf *SfDB) query(ctx context.Context, q queryer, stmt string, args ...any) (*sql.Rows, error) {
+	qctx, queryID := withQueryID(ctx)
+	rows, err := q.QueryContext(qctx, stmt, args...)
+	if err != nil {
+		logStatementError(sf.logger, ctx, stmt, queryID(err), err)
+	}
+	return rows, err
+}
+
+// withQueryID returns a context that captures the snowflake query id of the next statement, and a
+// function that returns it. Failed statements report their query id in the error, so it is preferred.
+func withQueryID(ctx context.Context) (context.Context, func(err error) string) {
+	ch := make(chan string, 1)
+	return gsf.WithQueryIDChan(ctx, ch), func(err error) string {
+		var sfErr *gsf.SnowflakeError
+		if errors.As(err, &sfErr) && sfErr.QueryID != "" {
+			return sfErr.QueryID
+		}
+		select {
+		case id := <-ch:
+			return id
+		default:
+			return ""
+		}
+	}
+}
+
+func logStatementError(logger common.Logger, ctx context.Context, stmt string, queryID string, err error) {
+	args := append([]any{"error", err, "query_id", queryID, "statement", strings.TrimSpace(stmt)},
+		queryTagOf(ctx).logArgs()...)
+	logger.Error("Snowflake statement failed", args...)
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	gsf "github.com/snowflakedb/gosnowflake"
+)
+
+func TestQueryTag(t *testing.T) {
+	conf, metrics, logger := testDeps()
+	tDB, err := newTestDB(2000, conf, logger, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// use a mock without the generic session expectations of newTestDB
+	dbNew, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := tDB.sfDB
+	sf.db = dbNew
+	ds := &Dataset{name: "o'brien.people", db: sf, logger: logger, service: "snowflake"}
+
+	t.Run("should tag the session of a request", func(t *testing.T) {
+		mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("USE SECONDARY ROLES ALL;").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`ALTER SESSION SET QUERY_TAG = '\{"service":"snowflake","dataset":"o''brien.people",` +
+			`"operation":"fullsync","layer_request_id":"[0-9a-f-]{36}"\}';`).WillReturnResult(sqlmock.NewResult(0, 0))
+		ctx, release, err := ds.dbCtx(context.Background(), OperationFullSync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		tag := queryTagOf(ctx)
+		if tag == nil || tag.Operation != OperationFullSync || tag.Dataset != "o'brien.people" {
+			t.Fatalf("expected query tag in context, got %+v", tag)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should log the query id of failed statements", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), QueryTag, newQueryTag("snowflake", "people", OperationIncremental))
+		mock.ExpectExec("DROP TABLE X").WillReturnError(&gsf.SnowflakeError{Number: 2003, QueryID: "01b2-query", Message: "does not exist"})
+		if _, err := sf.exec(ctx, dbNew, "DROP TABLE X"); err == nil {
+			t.Fatal("expected error")
+		}
+		logs := strings.Join(logger.(*testLogger).logs, "\n")
+		if !strings.Contains(logs, "Snowflake statement failed ERROR error") ||
+			!strings.Contains(logs, "query_id 01b2-query") || !strings.Contains(logs, "operation incremental") {
+			t.Fatalf("expected failure with query id and tag in logs, got %s", logs)
+		}
+	})
+}
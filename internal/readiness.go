@@ -0,0 +1,192 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+var (
+	defaultReadinessInterval = 30 * time.Second
+	defaultFullSyncTimeout   = 6 * time.Hour
+)
+
+type readinessConfig struct {
+	interval        time.Duration
+	fullSyncTimeout time.Duration
+}
+
+// readinessConfigOf reads the readiness settings from the system config
+func readinessConfigOf(conf *common.Config) *readinessConfig {
+	return &readinessConfig{
+		interval:        confDuration(conf, ReadinessInterval),
+		fullSyncTimeout: confDuration(conf, FullSyncTimeout),
+	}
+}
+
+// connectivityState holds the result of the last periodic snowflake check
+type connectivityState struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+func (c *connectivityState) set(t time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = t
+	c.err = err
+}
+
+func (c *connectivityState) last() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checked, c.err
+}
+
+type connectivityCheck struct {
+	OK        bool   `json:"ok"`
+	CheckedAt string `json:"checked_at,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type memoryCheck struct {
+	OK bool `json:"ok"`
+	// headroom values are only reported when memory stats are available
+	HeadroomBytes    *int `json:"headroom_bytes,omitempty"`
+	MinHeadroomBytes int  `json:"min_headroom_bytes"`
+}
+
+type fullSyncCheck struct {
+	OK      bool     `json:"ok"`
+	Timeout string   `json:"timeout"`
+	Stuck   []string `json:"stuck,omitempty"`
+}
+
+// readinessReport is the response of the readiness endpoint
+type readinessReport struct {
+	Ready     bool              `json:"ready"`
+	Snowflake connectivityCheck `json:"snowflake"`
+	Memory    memoryCheck       `json:"memory"`
+	FullSyncs fullSyncCheck     `json:"full_syncs"`
+}
+
+// startConnectivityChecks checks snowflake connectivity right away, and then at every interval
+// until stopConnectivityChecks is called.
+func (dl *SnowflakeDataLayer) startConnectivityChecks(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dl.connectivity.stop = cancel
+	dl.connectivity.done = make(chan struct{})
+	go func() {
+		defer close(dl.connectivity.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			dl.checkConnectivity(ctx, interval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (dl *SnowflakeDataLayer) stopConnectivityChecks() {
+	if dl.connectivity.stop == nil {
+		return
+	}
+	dl.connectivity.stop()
+	<-dl.connectivity.done
+}
+
+// checkConnectivity runs SELECT 1 in a new pooled connection, and records the result
+func (dl *SnowflakeDataLayer) checkConnectivity(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := func() error {
+		conn, err := dl.db.newConnection(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, "SELECT 1;")
+		return err
+	}()
+	if ctx.Err() == context.Canceled {
+		// the layer is stopping
+		return
+	}
+	if err != nil {
+		dl.logger.Warn("Snowflake connectivity check failed", "error", err)
+	}
+	dl.connectivity.set(time.Now(), err)
+}
+
+// stuckFullSyncs returns the datasets with a full sync that started longer than timeout ago, see loadSnapshot.fullSyncStuck
+func (dl *SnowflakeDataLayer) stuckFullSyncs(now time.Time, timeout time.Duration) []string {
+	var stuck []string
+	dl.loadStates.m.Range(func(key, value any) bool {
+		if value.(*loadState).snapshot().fullSyncStuck(now, timeout) {
+			stuck = append(stuck, key.(string))
+		}
+		return true
+	})
+	sort.Strings(stuck)
+	return stuck
+}
+
+// readiness combines the last connectivity check, the memory headroom and the full sync states.
+// The layer is ready when none of them report a problem.
+func (dl *SnowflakeDataLayer) readiness(now time.Time) *readinessReport {
+	rc := readinessConfigOf(dl.config)
+	report := &readinessReport{}
+
+	checked, err := dl.connectivity.last()
+	switch {
+	case checked.IsZero():
+		report.Snowflake.Error = "not checked yet"
+	case err != nil:
+		report.Snowflake.Error = err.Error()
+	case now.Sub(checked) > 3*rc.interval:
+		report.Snowflake.Error = "last successful check is outdated"
+	default:
+		report.Snowflake.OK = true
+	}
+	if !checked.IsZero() {
+		report.Snowflake.CheckedAt = checked.UTC().Format(time.RFC3339)
+	}
+
+	headroom, minHeadroom, known := dl.memoryGuard().headroom()
+	report.Memory.MinHeadroomBytes = minHeadroom
+	report.Memory.OK = !known || headroom >= minHeadroom
+	if known {
+		report.Memory.HeadroomBytes = &headroom
+	}
+
+	report.FullSyncs.Timeout = rc.fullSyncTimeout.String()
+	report.FullSyncs.Stuck = dl.stuckFullSyncs(now, rc.fullSyncTimeout)
+	report.FullSyncs.OK = len(report.FullSyncs.Stuck) == 0
+
+	report.Ready = report.Snowflake.OK && report.Memory.OK && report.FullSyncs.OK
+	return report
+}
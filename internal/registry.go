@@ -0,0 +1,46 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import "sort"
+
+// datasetRegistry is a snapshot of the configured datasets.
+// It is never changed after it is published, so it can be read without locking.
+type datasetRegistry struct {
+	datasets map[string]*Dataset
+}
+
+// registry returns the current snapshot of configured datasets
+func (dl *SnowflakeDataLayer) registry() *datasetRegistry {
+	if r := dl.datasets.Load(); r != nil {
+		return r
+	}
+	return &datasetRegistry{}
+}
+
+func (r *datasetRegistry) get(name string) (*Dataset, bool) {
+	ds, found := r.datasets[name]
+	return ds, found
+}
+
+// names returns the sorted dataset names
+func (r *datasetRegistry) names() []string {
+	names := make([]string, 0, len(r.datasets))
+	for name := range r.datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
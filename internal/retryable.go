@@ -0,0 +1,54 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// ErrRetryable matches all errors from temporary conditions, like an overloaded layer.
+// Use errors.Is(layerErr.Underlying(), ErrRetryable) to tell them apart from other failures.
+var ErrRetryable = errors.New("temporary condition, retry later")
+
+// RetryableError is a rejection that the client should retry after a back-off.
+//
+// common-datalayer maps every LayerError to status 500 and does not allow response headers,
+// so the layer cannot respond with 503 and a Retry-After header. The back-off hint is part
+// of the error message instead, e.g. "...: retry after 30s".
+type RetryableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetryableError) Is(target error) bool {
+	return target == ErrRetryable
+}
+
+// retryable wraps err in a RetryableError with the given back-off hint
+func retryable(err error, retryAfter time.Duration) common.LayerError {
+	return common.Err(&RetryableError{Err: err, RetryAfter: retryAfter}, common.LayerErrorInternal)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// SecretProvider looks up secrets by name. Implementations can read from mounted secret volumes
+// or from external secret stores. Secret values must never be logged.
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// FileSecretProvider reads secrets from files, e.g. a mounted kubernetes secret.
+// Secret names are file paths, relative to Dir if Dir is set.
+type FileSecretProvider struct {
+	Dir string
+}
+
+func (p FileSecretProvider) Secret(_ context.Context, name string) ([]byte, error) {
+	path := name
+	if p.Dir != "" && !filepath.IsAbs(name) {
+		path = filepath.Join(p.Dir, name)
+	}
+	return os.ReadFile(path)
+}
+
+// privateKey returns the private key of the snowflake user. It is taken from snowflake_private_key,
+// from the file in snowflake_private_key_file, or from the secret provider by snowflake_private_key_secret.
+func privateKey(ctx context.Context, conf *common.Config, secrets SecretProvider) (*rsa.PrivateKey, error) {
+	var data []byte
+	if key := confString(conf, SnowflakePrivateKey); key != "" {
+		data = []byte(key)
+	} else if file := confString(conf, SnowflakePrivateKeyFile); file != "" {
+		b, err := FileSecretProvider{}.Secret(ctx, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", SnowflakePrivateKeyFile, err)
+		}
+		data = b
+	} else if name := confString(conf, SnowflakePrivateKeySecret); name != "" {
+		b, err := secrets.Secret(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s %s: %w", SnowflakePrivateKeySecret, name, err)
+		}
+		data = b
+	} else {
+		return nil, errMissingPrivateKey
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		// parse errors never contain the key itself
+		return nil, fmt.Errorf("invalid snowflake private key: %w", err)
+	}
+	return key, nil
+}
+
+var errMissingPrivateKey = fmt.Errorf("missing required config value %s, %s or %s",
+	SnowflakePrivateKey, SnowflakePrivateKeyFile, SnowflakePrivateKeySecret)
+
+// parsePrivateKey accepts an unencrypted PKCS8 key, either PEM encoded or as base64 without header and footer
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	data = bytes.TrimSpace(data)
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an rsa key")
+	}
+	return key, nil
+}
+
+// secretKeys are substrings of config keys whose values must not be reported, e.g. in MetaData
+var secretKeys = []string{"private_key", "password", "secret", "token"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type mapSecrets map[string]string
+
+func (m mapSecrets) Secret(_ context.Context, name string) ([]byte, error) {
+	if v, ok := m[name]; ok {
+		return []byte(v), nil
+	}
+	return nil, errors.New("secret not found")
+}
+
+func TestSecrets(t *testing.T) {
+	conf, metrics, logger := testDeps()
+	key := conf.NativeSystemConfig[SnowflakePrivateKey].(string)
+	withoutKey := func() {
+		conf, metrics, logger = testDeps()
+		delete(conf.NativeSystemConfig, SnowflakePrivateKey)
+	}
+
+	t.Run("should read private key file relative to dir", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "key"), []byte(key+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		withoutKey()
+		conf.NativeSystemConfig[SnowflakePrivateKeySecret] = "key"
+		k, err := privateKey(context.Background(), conf, FileSecretProvider{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.N.BitLen() != 512 {
+			t.Fatalf("unexpected key size %d", k.N.BitLen())
+		}
+	})
+	t.Run("should start with a pem encoded snowflake_private_key_file", func(t *testing.T) {
+		der, _ := base64.StdEncoding.DecodeString(key)
+		file := filepath.Join(t.TempDir(), "rsa_key.p8")
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		withoutKey()
+		conf.NativeSystemConfig[SnowflakePrivateKeyFile] = file
+		subject, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject.Stop(context.Background())
+	})
+	t.Run("should resolve snowflake_private_key_secret with the given provider", func(t *testing.T) {
+		withoutKey()
+		conf.NativeSystemConfig[SnowflakePrivateKeySecret] = "snowflake/key"
+		subject, err := NewSnowflakeDataLayerWithSecrets(mapSecrets{"snowflake/key": key})(conf, logger, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject.Stop(context.Background())
+
+		conf.NativeSystemConfig[SnowflakePrivateKeySecret] = "other"
+		_, err = NewSnowflakeDataLayerWithSecrets(mapSecrets{})(conf, logger, metrics)
+		if err == nil || err.Error() != "failed to read snowflake_private_key_secret other: secret not found" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("should fail on missing private key", func(t *testing.T) {
+		withoutKey()
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if !errors.Is(err, errMissingPrivateKey) {
+			t.Fatalf("expected missing private key, got %v", err)
+		}
+	})
+	t.Run("should fail on missing private key file", func(t *testing.T) {
+		withoutKey()
+		conf.NativeSystemConfig[SnowflakePrivateKeyFile] = filepath.Join(t.TempDir(), "missing")
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err == nil || !strings.HasPrefix(err.Error(), "failed to read snowflake_private_key_file") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("should not report the key in errors", func(t *testing.T) {
+		withoutKey()
+		// a valid base64 string, but not a key
+		invalid := base64.StdEncoding.EncodeToString([]byte("not a private key at all"))
+		conf.NativeSystemConfig[SnowflakePrivateKey] = invalid
+		_, err := NewSnowflakeDataLayer(conf, logger, metrics)
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid snowflake private key") {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if strings.Contains(err.Error(), invalid) || strings.Contains(err.Error(), "not a private key") {
+			t.Fatalf("key in error: %v", err)
+		}
+	})
+	t.Run("should recognize secret config keys", func(t *testing.T) {
+		for _, k := range []string{SnowflakePrivateKey, SnowflakePrivateKeyFile, "db_password", "API_TOKEN", "client_secret"} {
+			if !isSecretKey(k) {
+				t.Errorf("expected %s to be secret", k)
+			}
+		}
+		for _, k := range []string{TableName, Database, Schema, RawColumn} {
+			if isSecretKey(k) {
+				t.Errorf("expected %s not to be secret", k)
+			}
+		}
+	})
+}
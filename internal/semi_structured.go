@@ -0,0 +1,121 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	common "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// semiStructuredTypes are the snowflake types that the driver returns as json text
+var semiStructuredTypes = map[string]bool{"VARIANT": true, "OBJECT": true, "ARRAY": true}
+
+// semiStructuredColumns marks the result columns that are parsed before mapping: columns that snowflake
+// reports as variant, object or array, and columns of mappings with one of those datatypes.
+func semiStructuredColumns(colTypes []*sql.ColumnType, config *common.OutgoingMappingConfig) []bool {
+	mapped := map[string]bool{}
+	if config != nil {
+		for _, pm := range config.PropertyMappings {
+			if semiStructuredTypes[outgoingTypes[pm.Datatype]] {
+				mapped[pm.Property] = true
+			}
+		}
+	}
+	res := make([]bool, len(colTypes))
+	for i, t := range colTypes {
+		res[i] = semiStructuredTypes[t.DatabaseTypeName()] || mapped[t.Name()]
+	}
+	return res
+}
+
+// mapperConfig returns config without the semi-structured datatypes, which the common-datalayer mapper
+// does not know. Their columns are parsed by the layer already.
+func mapperConfig(config *common.OutgoingMappingConfig) *common.OutgoingMappingConfig {
+	if config == nil {
+		return nil
+	}
+	res := *config
+	res.PropertyMappings = make([]*common.ItemToEntityPropertyMapping, len(config.PropertyMappings))
+	for i, pm := range config.PropertyMappings {
+		if semiStructuredTypes[outgoingTypes[pm.Datatype]] {
+			c := *pm
+			c.Datatype = ""
+			pm = &c
+		}
+		res.PropertyMappings[i] = pm
+	}
+	return &res
+}
+
+// semiStructuredValue parses the json text of a semi-structured column. Objects become nested entities,
+// with their keys as properties under baseURI, and arrays become lists.
+func semiStructuredValue(raw any, baseURI string) (any, error) {
+	var data []byte
+	switch v := raw.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return raw, nil
+	}
+	// numbers are kept as written, large integers would lose precision as float64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var parsed any
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	return nestedValue(parsed, baseURI), nil
+}
+
+func nestedValue(v any, baseURI string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		entity := egdm.NewEntity()
+		for k, pv := range v {
+			entity.Properties[baseURI+k] = nestedValue(pv, baseURI)
+		}
+		return entity
+	case []any:
+		for i, e := range v {
+			v[i] = nestedValue(e, baseURI)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// parseSemiStructured replaces the json text of the semi-structured columns in a scanned row
+func parseSemiStructured(row []any, cols []bool, colTypes []*sql.ColumnType, baseURI string) error {
+	for x, semi := range cols {
+		if !semi {
+			continue
+		}
+		val := row[x].(*any)
+		parsed, err := semiStructuredValue(*val, baseURI)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", colTypes[x].Name(), err)
+		}
+		*val = parsed
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+type settingType string
+
+const (
+	stringSetting   settingType = "a string"
+	boolSetting     settingType = "a boolean"
+	intSetting      settingType = "an integer"
+	floatSetting    settingType = "a number"
+	durationSetting settingType = "a duration string"
+	listSetting     settingType = "a list of strings"
+)
+
+// setting describes one option of the native system config
+type setting struct {
+	key string
+	// environment variable that overrides the config file value
+	env string
+	typ settingType
+	// typed default, used when the option is not set
+	def      any
+	required bool
+	// validate checks the typed value, nil if any value of the type is valid
+	validate func(key string, v any) error
+}
+
+// settings are all options of the native system config. They drive EnvOverrides, validateConfig
+// and the typed accessors like confString.
+var settings = []setting{
+	{key: SnowflakeDB, env: "SNOWFLAKE_DB", typ: stringSetting, required: true},
+	{key: SnowflakeSchema, env: "SNOWFLAKE_SCHEMA", typ: stringSetting, required: true},
+	{key: SnowflakeUser, env: "SNOWFLAKE_USER", typ: stringSetting, required: true},
+	{key: SnowflakeAccount, env: "SNOWFLAKE_ACCOUNT", typ: stringSetting, required: true},
+	{key: SnowflakeWarehouse, env: "SNOWFLAKE_WAREHOUSE", typ: stringSetting, required: true},
+	// one of the private key settings is required, see validateConfig
+	{key: SnowflakePrivateKey, env: "SNOWFLAKE_PRIVATE_KEY", typ: stringSetting, def: ""},
+	{key: SnowflakePrivateKeyFile, env: "SNOWFLAKE_PRIVATE_KEY_FILE", typ: stringSetting, def: ""},
+	{key: SnowflakePrivateKeySecret, env: "SNOWFLAKE_PRIVATE_KEY_SECRET", typ: stringSetting, def: ""},
+	{key: MemoryHeadroom, env: "MEMORY_HEADROOM", typ: intSetting, def: defaultMemoryHeadroom, validate: intAtLeast(1)},
+	{key: MemoryRetryAfter, env: "MEMORY_RETRY_AFTER", typ: durationSetting, def: defaultMemoryRetryAfter, validate: positiveDuration},
+	{key: LatestTable, env: "LATEST_TABLE", typ: boolSetting, def: false},
+	{key: LatestStrategy, env: "LATEST_STRATEGY", typ: stringSetting, def: LatestStrategyMerge,
+		validate: oneOf(LatestStrategyMerge, LatestStrategyView, LatestStrategyDynamicTable)},
+	{key: DiscoverTables, env: "DISCOVER_TABLES", typ: boolSetting, def: true},
+	{key: DiscoverySchemas, env: "DISCOVERY_SCHEMAS", typ: listSetting, validate: databaseSchemas},
+	{key: DiscoveryTTL, env: "DISCOVERY_TTL", typ: durationSetting, def: defaultDiscoveryTTL, validate: positiveDuration},
+	{key: PreflightMode, env: "PREFLIGHT_MODE", typ: stringSetting, def: PreflightWarn,
+		validate: oneOf(PreflightOff, PreflightWarn, PreflightStrict)},
+	{key: HealthPort, env: "HEALTH_PORT", typ: stringSetting, def: ""},
+	{key: ReadinessInterval, env: "READINESS_INTERVAL", typ: durationSetting, def: defaultReadinessInterval, validate: positiveDuration},
+	{key: FullSyncTimeout, env: "FULL_SYNC_TIMEOUT", typ: durationSetting, def: defaultFullSyncTimeout, validate: positiveDuration},
+	{key: MaxConcurrentRequests, env: "MAX_CONCURRENT_REQUESTS", typ: intSetting, def: 0, validate: intAtLeast(0)},
+	{key: MaxConcurrentRequestsPerDataset, env: "MAX_CONCURRENT_REQUESTS_PER_DATASET", typ: intSetting, def: 0, validate: intAtLeast(0)},
+	{key: AdmissionTimeout, env: "ADMISSION_TIMEOUT", typ: durationSetting, def: defaultAdmissionTimeout, validate: positiveDuration},
+	{key: BatchSize, env: "BATCH_SIZE", typ: intSetting, def: int(defaultBatchSize), validate: intAtLeast(1)},
+	{key: BatchKeyTTL, env: "BATCH_KEY_TTL", typ: durationSetting, def: defaultBatchKeyTTL, validate: positiveDuration},
+	{key: MaxFileBytes, env: "MAX_FILE_BYTES", typ: intSetting, def: 0, validate: intAtLeast(0)},
+	{key: GzipLevel, env: "GZIP_LEVEL", typ: intSetting, def: gzip.DefaultCompression,
+		validate: intBetween(gzip.HuffmanOnly, gzip.BestCompression)},
+	{key: MaxFilesPerCopy, env: "MAX_FILES_PER_COPY", typ: intSetting, def: defaultMaxFilesPerCopy,
+		validate: intBetween(1, defaultMaxFilesPerCopy)},
+	{key: LayerMode, env: "LAYER_MODE", typ: stringSetting, def: LayerModeReadWrite,
+		validate: oneOf(LayerModeRead, LayerModeWrite, LayerModeReadWrite)},
+	{key: ImplicitWrites, env: "IMPLICIT_WRITES", typ: boolSetting, def: true},
+	{key: ImplicitReadAllow, env: "IMPLICIT_READ_ALLOW", typ: listSetting, validate: globPatterns},
+	{key: ImplicitReadDeny, env: "IMPLICIT_READ_DENY", typ: listSetting, validate: globPatterns},
+	{key: TracingExporter, env: "TRACING_EXPORTER", typ: stringSetting, def: TracingNone,
+		validate: oneOf(TracingNone, TracingStdout, TracingOTLP)},
+	{key: TracingEndpoint, env: "TRACING_ENDPOINT", typ: stringSetting, def: ""},
+	{key: TracingSampleRatio, env: "TRACING_SAMPLE_RATIO", typ: floatSetting, def: 1.0, validate: floatBetween(0, 1)},
+}
+
+func settingFor(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// parse converts a config value to the type of the setting.
+// Config values are json decoded, so integers may be float64, and durations are strings.
+func (s *setting) parse(v any) (any, error) {
+	switch s.typ {
+	case stringSetting:
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+	case boolSetting:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case intSetting:
+		if n, ok := asInt(v); ok {
+			return n, nil
+		}
+	case floatSetting:
+		switch f := v.(type) {
+		case float64:
+			return f, nil
+		case int:
+			return float64(f), nil
+		}
+	case durationSetting:
+		if str, ok := v.(string); ok {
+			d, err := time.ParseDuration(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.key, err)
+			}
+			return d, nil
+		}
+	case listSetting:
+		return stringList(v, s.key)
+	}
+	return nil, fmt.Errorf("%s must be %s, got %T", s.key, s.typ, v)
+}
+
+// check parses and validates a config value
+func (s *setting) check(v any) (any, error) {
+	typed, err := s.parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if s.validate != nil {
+		if err := s.validate(s.key, typed); err != nil {
+			return nil, err
+		}
+	}
+	return typed, nil
+}
+
+// fromEnv converts an environment variable to the config value of the setting.
+// Lists are comma separated.
+func (s *setting) fromEnv(v string) (any, error) {
+	var res any
+	var err error
+	switch s.typ {
+	case boolSetting:
+		res, err = strconv.ParseBool(v)
+	case intSetting:
+		res, err = strconv.Atoi(v)
+	case floatSetting:
+		res, err = strconv.ParseFloat(v, 64)
+	case durationSetting:
+		res = v
+		_, err = time.ParseDuration(v)
+	case listSetting:
+		var l []string
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				l = append(l, e)
+			}
+		}
+		res = l
+	default:
+		res = v
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+	}
+	return res, nil
+}
+
+// EnvOverrides sets the system config options from their environment variables, see settings
+func EnvOverrides(config *common.Config) error {
+	if config.NativeSystemConfig == nil {
+		config.NativeSystemConfig = map[string]any{}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			value, err := s.fromEnv(v)
+			if err != nil {
+				return err
+			}
+			config.NativeSystemConfig[s.key] = value
+		}
+	}
+	return nil
+}
+
+// validateSettings checks all system config options, and reports all problems in one error
+func validateSettings(conf map[string]any) error {
+	var errs []error
+	for _, s := range settings {
+		v, ok := conf[s.key]
+		if !ok || v == nil || v == "" {
+			if s.required {
+				errs = append(errs, fmt.Errorf("missing required config value %s", s.key))
+			}
+			continue
+		}
+		if _, err := s.check(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// confValue returns the typed value of a system config option, or its default.
+// Invalid values are rejected at startup, so they fall back to the default here.
+func confValue(conf *common.Config, key string) any {
+	s := settingFor(key)
+	if s == nil {
+		return nil
+	}
+	if conf == nil {
+		return s.def
+	}
+	v, ok := conf.NativeSystemConfig[key]
+	if !ok || v == nil || v == "" {
+		return s.def
+	}
+	typed, err := s.check(v)
+	if err != nil {
+		return s.def
+	}
+	return typed
+}
+
+func confString(conf *common.Config, key string) string {
+	s, _ := confValue(conf, key).(string)
+	return s
+}
+
+func confBool(conf *common.Config, key string) bool {
+	b, _ := confValue(conf, key).(bool)
+	return b
+}
+
+func confInt(conf *common.Config, key string) int {
+	n, _ := confValue(conf, key).(int)
+	return n
+}
+
+func confFloat(conf *common.Config, key string) float64 {
+	f, _ := confValue(conf, key).(float64)
+	return f
+}
+
+func confDuration(conf *common.Config, key string) time.Duration {
+	d, _ := confValue(conf, key).(time.Duration)
+	return d
+}
+
+func confStrings(conf *common.Config, key string) []string {
+	l, _ := confValue(conf, key).([]string)
+	return l
+}
+
+// asInt accepts ints and whole float64 values, which is how json numbers are decoded
+func asInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+func intAtLeast(min int) func(string, any) error {
+	return func(key string, v any) error {
+		if v.(int) < min {
+			return fmt.Errorf("%s must be an integer of at least %d, got %v", key, min, v)
+		}
+		return nil
+	}
+}
+
+func intBetween(min int, max int) func(string, any) error {
+	return func(key string, v any) error {
+		if n := v.(int); n < min || n > max {
+			return fmt.Errorf("%s must be an integer between %d and %d, got %v", key, min, max, v)
+		}
+		return nil
+	}
+}
+
+func floatBetween(min float64, max float64) func(string, any) error {
+	return func(key string, v any) error {
+		if f := v.(float64); f < min || f > max {
+			return fmt.Errorf("%s must be a number between %v and %v, got %v", key, min, max, v)
+		}
+		return nil
+	}
+}
+
+func positiveDuration(key string, v any) error {
+	if v.(time.Duration) <= 0 {
+		return fmt.Errorf("%s must be positive, got %s", key, v)
+	}
+	return nil
+}
+
+func oneOf(values ...string) func(string, any) error {
+	return func(key string, v any) error {
+		for _, value := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid %s %v, expected one of %s", key, v, strings.Join(values, ", "))
+	}
+}
+
+// globPatterns checks that all entries are valid path.Match patterns
+func globPatterns(key string, v any) error {
+	for _, p := range v.([]string) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid %s entry %q: %w", key, p, err)
+		}
+	}
+	return nil
+}
+
+// databaseSchemas checks that all entries have the form database.schema
+func databaseSchemas(key string, v any) error {
+	for _, s := range v.([]string) {
+		tokens := strings.Split(s, ".")
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return fmt.Errorf("invalid %s entry %q, expected database.schema", key, s)
+		}
+	}
+	return nil
+}
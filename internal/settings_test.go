@@ -0,0 +1,151 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// settingCases has a valid env value with its typed value, and an invalid config value, per setting.
+// Required settings have no invalid value besides a missing one.
+var settingCases = map[string]struct {
+	env     string
+	typed   any
+	invalid any
+}{
+	SnowflakeDB:                     {env: "db", typed: "db", invalid: 1},
+	SnowflakeSchema:                 {env: "schema", typed: "schema", invalid: 1},
+	SnowflakeUser:                   {env: "user", typed: "user", invalid: 1},
+	SnowflakeAccount:                {env: "account", typed: "account", invalid: 1},
+	SnowflakeWarehouse:              {env: "wh", typed: "wh", invalid: 1},
+	SnowflakePrivateKey:             {env: "key", typed: "key", invalid: 1},
+	SnowflakePrivateKeyFile:         {env: "/secrets/key", typed: "/secrets/key", invalid: 1},
+	SnowflakePrivateKeySecret:       {env: "snowflake/key", typed: "snowflake/key", invalid: 1},
+	MemoryHeadroom:                  {env: "200", typed: 200, invalid: 0},
+	MemoryRetryAfter:                {env: "10s", typed: 10 * time.Second, invalid: "-1s"},
+	LatestTable:                     {env: "true", typed: true, invalid: "yes"},
+	LatestStrategy:                  {env: "view", typed: LatestStrategyView, invalid: "table"},
+	DiscoverTables:                  {env: "false", typed: false, invalid: "no"},
+	DiscoverySchemas:                {env: "db1.s1, db2.s2", typed: []string{"db1.s1", "db2.s2"}, invalid: []any{"db1"}},
+	DiscoveryTTL:                    {env: "1h", typed: time.Hour, invalid: "1 hour"},
+	PreflightMode:                   {env: "strict", typed: PreflightStrict, invalid: "on"},
+	HealthPort:                      {env: "8081", typed: "8081", invalid: 8081},
+	ReadinessInterval:               {env: "5s", typed: 5 * time.Second, invalid: "0s"},
+	FullSyncTimeout:                 {env: "2h", typed: 2 * time.Hour, invalid: 10},
+	MaxConcurrentRequests:           {env: "4", typed: 4, invalid: -1},
+	MaxConcurrentRequestsPerDataset: {env: "2", typed: 2, invalid: 1.5},
+	AdmissionTimeout:                {env: "500ms", typed: 500 * time.Millisecond, invalid: "-1m"},
+	BatchSize:                       {env: "1000", typed: 1000, invalid: 0},
+	BatchKeyTTL:                     {env: "24h", typed: 24 * time.Hour, invalid: "1 day"},
+	MaxFileBytes:                    {env: "1048576", typed: 1048576, invalid: "1MB"},
+	GzipLevel:                       {env: "9", typed: 9, invalid: 10},
+	MaxFilesPerCopy:                 {env: "100", typed: 100, invalid: 1001},
+	LayerMode:                       {env: "read", typed: LayerModeRead, invalid: "readonly"},
+	ImplicitWrites:                  {env: "false", typed: false, invalid: "off"},
+	ImplicitReadAllow:               {env: "DB.PUBLIC.*,DB.SHARED.T?", typed: []string{"DB.PUBLIC.*", "DB.SHARED.T?"}, invalid: []any{"DB.[A"}},
+	ImplicitReadDeny:                {env: "*.SECRET.*", typed: []string{"*.SECRET.*"}, invalid: 5},
+	TracingExporter:                 {env: "otlp", typed: TracingOTLP, invalid: "jaeger"},
+	TracingEndpoint:                 {env: "http://collector:4318", typed: "http://collector:4318", invalid: true},
+	TracingSampleRatio:              {env: "0.25", typed: 0.25, invalid: 1.5},
+}
+
+func TestSettings(t *testing.T) {
+	t.Run("should have test cases for all settings", func(t *testing.T) {
+		for _, s := range settings {
+			if _, ok := settingCases[s.key]; !ok {
+				t.Errorf("missing test case for %s", s.key)
+			}
+			if s.env != strings.ToUpper(s.key) {
+				t.Errorf("expected env %s for %s, got %s", strings.ToUpper(s.key), s.key, s.env)
+			}
+		}
+		if len(settingCases) != len(settings) {
+			t.Errorf("expected %d test cases, got %d", len(settings), len(settingCases))
+		}
+	})
+	for _, s := range settings {
+		c := settingCases[s.key]
+		t.Run(s.key, func(t *testing.T) {
+			t.Run("should use default when not set", func(t *testing.T) {
+				v := confValue(&common.Config{NativeSystemConfig: map[string]any{}}, s.key)
+				if !reflect.DeepEqual(v, s.def) {
+					t.Fatalf("expected default %v, got %v", s.def, v)
+				}
+			})
+			t.Run("should override from env", func(t *testing.T) {
+				t.Setenv(s.env, c.env)
+				conf := &common.Config{}
+				if err := EnvOverrides(conf); err != nil {
+					t.Fatal(err)
+				}
+				if v := confValue(conf, s.key); !reflect.DeepEqual(v, c.typed) {
+					t.Fatalf("expected %v (%T), got %v (%T)", c.typed, c.typed, v, v)
+				}
+				if _, err := s.check(conf.NativeSystemConfig[s.key]); err != nil {
+					t.Fatal(err)
+				}
+			})
+			t.Run("should reject invalid value", func(t *testing.T) {
+				err := validateSettings(map[string]any{s.key: c.invalid})
+				if err == nil || !strings.Contains(err.Error(), s.key) {
+					t.Fatalf("expected error for %s, got %v", s.key, err)
+				}
+			})
+			if s.required {
+				t.Run("should be required", func(t *testing.T) {
+					err := validateSettings(map[string]any{})
+					if err == nil || !strings.Contains(err.Error(), "missing required config value "+s.key) {
+						t.Fatalf("expected missing %s, got %v", s.key, err)
+					}
+				})
+			}
+		})
+	}
+	t.Run("should reject unparsable env values", func(t *testing.T) {
+		t.Setenv("MEMORY_HEADROOM", "500MB")
+		err := EnvOverrides(&common.Config{})
+		if err == nil || !strings.Contains(err.Error(), "invalid MEMORY_HEADROOM") {
+			t.Fatalf("expected invalid MEMORY_HEADROOM, got %v", err)
+		}
+	})
+	t.Run("should apply MEMORY_HEADROOM from env to the memory guard", func(t *testing.T) {
+		t.Setenv("MEMORY_HEADROOM", "123")
+		conf := &common.Config{}
+		if err := EnvOverrides(conf); err != nil {
+			t.Fatal(err)
+		}
+		if h := confInt(conf, MemoryHeadroom); h != 123 {
+			t.Fatalf("expected headroom 123, got %d", h)
+		}
+	})
+	t.Run("should accept json decoded numbers", func(t *testing.T) {
+		conf := &common.Config{NativeSystemConfig: map[string]any{
+			BatchSize:          float64(100),
+			TracingSampleRatio: float64(0),
+		}}
+		if err := validateSettings(conf.NativeSystemConfig); !strings.Contains(err.Error(), "missing required") ||
+			strings.Contains(err.Error(), BatchSize) || strings.Contains(err.Error(), TracingSampleRatio) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if confInt(conf, BatchSize) != 100 || confFloat(conf, TracingSampleRatio) != 0 {
+			t.Fatalf("unexpected values %v %v", confInt(conf, BatchSize), confFloat(conf, TracingSampleRatio))
+		}
+	})
+}
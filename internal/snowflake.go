@@ -16,12 +16,10 @@ package layer
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
@@ -34,26 +32,23 @@ type SfDB struct {
 	logger     common.Logger
 	metrics    common.Metrics
 	NewTmpFile func(dataset string) (*os.File, func(), error) // file, error, function to cleanup file
+	// tables that already have their configured table options applied
+	reconciledTables sync.Map
+	pipes            *pipeClient
 }
 
-func newSfDB(conf *common.Config, logger common.Logger, metrics common.Metrics) (*SfDB, error) {
+func newSfDB(conf *common.Config, logger common.Logger, metrics common.Metrics, secrets SecretProvider) (*SfDB, error) {
 	connectionString := "%s:%s@%s"
-	data, err := base64.StdEncoding.DecodeString(sysConfStr(conf, SnowflakePrivateKey))
+	parsedKey, err := privateKey(context.Background(), conf, secrets)
 	if err != nil {
 		return nil, err
 	}
-
-	parsedKey8, err := x509.ParsePKCS8PrivateKey(data)
-	if err != nil {
-		return nil, err
-	}
-	parsedKey := parsedKey8.(*rsa.PrivateKey)
 	config := &gsf.Config{
-		Account:       sysConfStr(conf, SnowflakeAccount),
-		User:          sysConfStr(conf, SnowflakeUser),
-		Database:      sysConfStr(conf, SnowflakeDB),
-		Schema:        sysConfStr(conf, SnowflakeSchema),
-		Warehouse:     sysConfStr(conf, SnowflakeWarehouse),
+		Account:       confString(conf, SnowflakeAccount),
+		User:          confString(conf, SnowflakeUser),
+		Database:      confString(conf, SnowflakeDB),
+		Schema:        confString(conf, SnowflakeSchema),
+		Warehouse:     confString(conf, SnowflakeWarehouse),
 		Region:        "eu-west-1",
 		Authenticator: gsf.AuthTypeJwt,
 		PrivateKey:    parsedKey,
@@ -63,10 +58,15 @@ func newSfDB(conf *common.Config, logger common.Logger, metrics common.Metrics)
 		return nil, err
 	}
 	connectionString = s
+	// the DSN fills in the host of the account, which the snowpipe REST API is called on
+	parsed, err := gsf.ParseDSN(s)
+	if err != nil {
+		return nil, err
+	}
 	// println(connectionString)
 	logger.Info("opening db")
-	if conf.NativeSystemConfig[LatestTable] != nil {
-		logger.Info(fmt.Sprintf("latest table is set to %v", conf.NativeSystemConfig[LatestTable]))
+	if _, ok := conf.NativeSystemConfig[LatestTable]; ok {
+		logger.Info(fmt.Sprintf("latest table is set to %v", confBool(conf, LatestTable)))
 	}
 	db, err := sql.Open("snowflake", connectionString)
 	if err != nil {
@@ -83,6 +83,8 @@ func newSfDB(conf *common.Config, logger common.Logger, metrics common.Metrics)
 		logger:     logger,
 		metrics:    metrics,
 		NewTmpFile: NewTmpFileWriter,
+		pipes: newPipeClient(fmt.Sprintf("%s://%s:%d", parsed.Protocol, parsed.Host, parsed.Port),
+			config.Account, config.User, parsedKey),
 	}, nil
 }
 
@@ -96,13 +98,82 @@ func (sf *SfDB) newConnection(ctx context.Context) (*sql.Conn, error) {
 }
 
 func (sf *SfDB) HasLatestActive(definition *common.DatasetDefinition) bool {
-	latestVal := definition.SourceConfig[LatestTable]
-	globalLatestVal := sf.conf.NativeSystemConfig[LatestTable]
-	if latestVal == nil && globalLatestVal == nil {
-		return false
+	if latestVal, ok := definition.SourceConfig[LatestTable].(bool); ok {
+		return latestVal
+	}
+	return confBool(sf.conf, LatestTable)
+}
+
+const (
+	LatestStrategyMerge        = "merge"
+	LatestStrategyView         = "view"
+	LatestStrategyDynamicTable = "dynamic_table"
+)
+
+// latestStrategy returns how the latest table of a dataset is maintained.
+// The dataset setting takes precedence over the system wide setting.
+func (sf *SfDB) latestStrategy(definition *common.DatasetDefinition) (string, error) {
+	var strategy any = confString(sf.conf, LatestStrategy)
+	if v, ok := definition.SourceConfig[LatestStrategy]; ok {
+		strategy = v
 	}
-	if latestVal != nil {
-		return latestVal.(bool)
+	switch strategy {
+	case nil, "", LatestStrategyMerge:
+		return LatestStrategyMerge, nil
+	case LatestStrategyView, LatestStrategyDynamicTable:
+		return strategy.(string), nil
+	default:
+		return "", fmt.Errorf("unsupported %s %v, expected one of %s, %s, %s", LatestStrategy, strategy,
+			LatestStrategyMerge, LatestStrategyView, LatestStrategyDynamicTable)
 	}
-	return globalLatestVal.(bool)
+}
+
+// hasLatestTable reports whether the layer maintains a latest table by merging every load into it.
+func (sf *SfDB) hasLatestTable(definition *common.DatasetDefinition) bool {
+	strategy, err := sf.latestStrategy(definition)
+	return sf.HasLatestActive(definition) && err == nil && strategy == LatestStrategyMerge
+}
+
+// hasLatestView reports whether the latest table is derived from the base table by snowflake,
+// either as view or as dynamic table. In this case loads only need to write to the base table.
+func (sf *SfDB) hasLatestView(definition *common.DatasetDefinition) bool {
+	strategy, err := sf.latestStrategy(definition)
+	return sf.HasLatestActive(definition) && err == nil && strategy != LatestStrategyMerge
+}
+
+const (
+	IngestModeCopy = "copy"
+	IngestModePipe = "pipe"
+)
+
+// ingestMode returns how incremental writes to the dataset are loaded.
+// Pipe mode only appends to the base table, so it cannot be combined with options that need
+// to run in the load transaction.
+func (sf *SfDB) ingestMode(definition *common.DatasetDefinition) (string, error) {
+	switch mode := definition.SourceConfig[IngestMode]; mode {
+	case nil, "", IngestModeCopy:
+		return IngestModeCopy, nil
+	case IngestModePipe:
+		if sf.hasLatestTable(definition) {
+			return "", fmt.Errorf("%s %s requires %s %s or %s for latest tables", IngestMode, IngestModePipe,
+				LatestStrategy, LatestStrategyView, LatestStrategyDynamicTable)
+		}
+		if sf.HasChangeDetection(definition) {
+			return "", fmt.Errorf("%s %s does not support %s", IngestMode, IngestModePipe, ChangeDetection)
+		}
+		if v, ok := definition.SourceConfig[IdempotentBatches].(bool); ok && v {
+			return "", fmt.Errorf("%s %s does not support %s", IngestMode, IngestModePipe, IdempotentBatches)
+		}
+		return IngestModePipe, nil
+	default:
+		return "", fmt.Errorf("unsupported %s %v, expected one of %s, %s", IngestMode, mode,
+			IngestModeCopy, IngestModePipe)
+	}
+}
+
+// HasChangeDetection reports whether incremental writes to the dataset should skip
+// entities that are unchanged compared to the latest stored version.
+func (sf *SfDB) HasChangeDetection(definition *common.DatasetDefinition) bool {
+	v, ok := definition.SourceConfig[ChangeDetection].(bool)
+	return ok && v
 }
@@ -19,7 +19,9 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -28,9 +30,12 @@ import (
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type query interface {
+	withFilters(where string, filters []filter) (query, error)
 	withSince(sinceColumn, sinceToken string) (query, error)
 	withLimit(limit int) (query, error)
 	run(ctx context.Context, releaseConn func()) (common.EntityIterator, common.LayerError)
@@ -39,9 +44,17 @@ type query interface {
 type sfQuery struct {
 	datasetDefinition *common.DatasetDefinition
 	logger            common.Logger
+	metrics           common.Metrics
 	ctx               context.Context
 	token             string
-	queryString       string
+	// table or subquery of the dataset
+	from string
+	// SELECT ... FROM ..., without conditions
+	queryString string
+	// conditions of the WHERE clause, with their bound parameters
+	conditions []string
+	args       []any
+	limit      int
 }
 
 func (sf *SfDB) createQuery(ctx context.Context, datasetDefinition *common.DatasetDefinition) (query, error) {
@@ -53,19 +66,70 @@ func (sf *SfDB) createQuery(ctx context.Context, datasetDefinition *common.Datas
 	} else {
 		columns = ColumnDDL(datasetDefinition.OutgoingMappingConfig)
 	}
+	// query datasets read from their statement as subquery, so that since, filters and limit apply to its result
+	from := fmt.Sprintf("%s.%s.%s",
+		datasetDefinition.SourceConfig[Database],
+		datasetDefinition.SourceConfig[Schema],
+		datasetDefinition.SourceConfig[TableName])
+	stmt, params := customQuery(datasetDefinition)
+	if stmt != "" {
+		from = "(" + stmt + ") AS q"
+	}
 	return &sfQuery{
 		datasetDefinition: datasetDefinition,
-		queryString: fmt.Sprintf("SELECT %s FROM %s.%s.%s",
-			columns,
-			datasetDefinition.SourceConfig[Database],
-			datasetDefinition.SourceConfig[Schema],
-			datasetDefinition.SourceConfig[TableName]),
-		logger: sf.logger,
-		ctx:    ctx,
-		token:  "",
+		from:              from,
+		queryString:       fmt.Sprintf("SELECT %s FROM %s", columns, from),
+		// copied, filters append to the args
+		args:    append([]any(nil), params...),
+		logger:  sf.logger,
+		metrics: sf.metrics,
+		ctx:     ctx,
+		token:   "",
 	}, nil
 }
 
+// snowflake error codes of compilation errors
+const (
+	sfErrInvalidIdentifier = 904
+	sfErrSyntax            = 1003
+	sfErrObjectNotFound    = 2003
+)
+
+var (
+	invalidIdentifierPattern = regexp.MustCompile(`invalid identifier '([^']*)'`)
+	objectNotFoundPattern    = regexp.MustCompile(`Object '([^']*)' does not exist`)
+)
+
+// queryError maps a failed query to a LayerError. Snowflake compiles a query before it returns any row,
+// so missing tables and columns are reported before streaming starts, without an extra lookup per request.
+// A missing or inaccessible table is reported as ErrNotFound, a missing column as bad parameter.
+func (q *sfQuery) queryError(err error) common.LayerError {
+	var sfErr *gsf.SnowflakeError
+	if !errors.As(err, &sfErr) {
+		return common.Err(err, common.LayerErrorInternal)
+	}
+	table := "table " + q.from
+	if stmt, _ := customQuery(q.datasetDefinition); stmt != "" {
+		table = "query"
+		if m := objectNotFoundPattern.FindStringSubmatch(sfErr.Message); m != nil {
+			table = "table " + m[1] + " in query"
+		}
+	}
+	switch sfErr.Number {
+	case sfErrObjectNotFound:
+		return common.Errorf(common.LayerErrorBadParameter, "%s of dataset %s %w",
+			table, q.datasetDefinition.DatasetName, ErrNotFound)
+	case sfErrInvalidIdentifier:
+		column := "unknown"
+		if m := invalidIdentifierPattern.FindStringSubmatch(sfErr.Message); m != nil {
+			column = m[1]
+		}
+		return common.Errorf(common.LayerErrorBadParameter, "column %s does not exist in %s of dataset %s",
+			column, table, q.datasetDefinition.DatasetName)
+	}
+	return common.Err(err, common.LayerErrorInternal)
+}
+
 // withSince implements query.
 func (q *sfQuery) withSince(sinceColumn, sinceToken string) (query, error) {
 	newSince := ""
@@ -79,19 +143,19 @@ func (q *sfQuery) withSince(sinceColumn, sinceToken string) (query, error) {
 	}
 
 	var res any
-	maxQ := fmt.Sprintf("SELECT MAX(%s) FROM %s.%s.%s", sinceColumn,
-		q.datasetDefinition.SourceConfig[Database],
-		q.datasetDefinition.SourceConfig[Schema],
-		q.datasetDefinition.SourceConfig[TableName])
+	maxQ := fmt.Sprintf("SELECT MAX(%s) FROM %s", sinceColumn, q.from)
 
+	// the since value is the max of the filtered rows
+	conditions := q.conditions
 	if sinceToken != "" {
-		maxQ = fmt.Sprintf("%s WHERE %s > %s", maxQ, sinceColumn, sinceVal)
+		conditions = append(conditions[:len(conditions):len(conditions)], fmt.Sprintf("%s > %s", sinceColumn, sinceVal))
 	}
+	maxQ += whereClause(conditions)
 	q.logger.Debug(maxQ)
-	row := conn.QueryRowContext(q.ctx, maxQ)
+	row := conn.QueryRowContext(q.ctx, maxQ, q.args...)
 	if row.Err() != nil {
 		q.logger.Error("Failed to read new since value", "error", row.Err())
-		return nil, row.Err()
+		return nil, q.queryError(row.Err())
 	}
 	row.Scan(&res)
 
@@ -115,57 +179,111 @@ func (q *sfQuery) withSince(sinceColumn, sinceToken string) (query, error) {
 	q.token = base64.URLEncoding.EncodeToString([]byte(newSince))
 
 	if sinceToken != "" {
-		q.queryString = fmt.Sprintf("%s WHERE %s > %s and %s <= %s",
-			q.queryString, sinceColumn, sinceVal, sinceColumn, newSince)
+		q.conditions = append(q.conditions, fmt.Sprintf("%s > %s and %s <= %s",
+			sinceColumn, sinceVal, sinceColumn, newSince))
 	} else {
 		// without since, just cap query
-		q.queryString = fmt.Sprintf("%s WHERE %s <= %s",
-			q.queryString, sinceColumn, newSince)
+		q.conditions = append(q.conditions, fmt.Sprintf("%s <= %s", sinceColumn, newSince))
 	}
 	return q, nil
 }
 
 // withLimit implements query.
 func (q *sfQuery) withLimit(limit int) (query, error) {
-	q.queryString = fmt.Sprintf("%s LIMIT %v", q.queryString, limit)
+	q.limit = limit
 	return q, nil
 }
 
+// withFilters implements query. where is the static predicate of the dataset, it is trusted config.
+// Request filters only use column names from filter_columns, and their values are bound parameters.
+func (q *sfQuery) withFilters(where string, filters []filter) (query, error) {
+	if where != "" {
+		q.conditions = append(q.conditions, "("+where+")")
+	}
+	for _, f := range filters {
+		if len(f.values) == 1 {
+			q.conditions = append(q.conditions, f.column+" = ?")
+		} else {
+			q.conditions = append(q.conditions,
+				fmt.Sprintf("%s IN (%s)", f.column, strings.TrimSuffix(strings.Repeat("?, ", len(f.values)), ", ")))
+		}
+		for _, v := range f.values {
+			q.args = append(q.args, v)
+		}
+	}
+	return q, nil
+}
+
+// statement returns the query with its WHERE clause and limit
+func (q *sfQuery) statement() string {
+	stmt := q.queryString + whereClause(q.conditions)
+	if q.limit > 0 {
+		stmt = fmt.Sprintf("%s LIMIT %v", stmt, q.limit)
+	}
+	return stmt
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " and ")
+}
+
 // run implements query.
 func (q *sfQuery) run(ctx context.Context, releaseConn func()) (common.EntityIterator, common.LayerError) {
 	conn := q.ctx.Value(Connection).(*sql.Conn)
-	q.logger.Debug(q.queryString)
-	qctx := gsf.WithStreamDownloader(ctx)
-	rows, err := conn.QueryContext(qctx, q.queryString)
+	stmt := q.statement()
+	q.logger.Debug(stmt)
+	m := newOpMetrics(q.metrics, q.logger, q.datasetDefinition.DatasetName, "query")
+	qctx, span := startSpan(ctx, "snowflake.query", q.datasetDefinition.DatasetName)
+	start := time.Now()
+	qctx, queryID := withQueryID(gsf.WithStreamDownloader(qctx))
+	rows, err := conn.QueryContext(qctx, stmt, q.args...)
 	if err != nil {
-		q.logger.Error("failed to query snowflake", "error", err)
+		logStatementError(q.logger, ctx, stmt, queryID(err), err)
+		m.incr("errors")
+		endSpan(span, err)
 		releaseConn()
-		return nil, common.Err(err, common.LayerErrorInternal)
+		return nil, q.queryError(err)
 	}
 
 	colTypes, err := rows.ColumnTypes()
 	if err != nil {
 		q.logger.Error("failed to get query result column types", "error", err)
+		endSpan(span, err)
 		releaseConn()
 		return nil, common.Err(err, common.LayerErrorInternal)
 	}
 
-	mapper := common.NewMapper(q.logger, nil, q.datasetDefinition.OutgoingMappingConfig)
+	m.timing("duration", start)
+	id := queryID(nil)
+	span.SetAttributes(attribute.String("query_id", id))
+	endSpan(span, nil)
+	_, iterSpan := startSpan(ctx, "snowflake.iterate", q.datasetDefinition.DatasetName)
+
+	mapper := common.NewMapper(q.logger, nil, mapperConfig(q.datasetDefinition.OutgoingMappingConfig))
 
 	return &entIter{
-		logger:  q.logger,
-		mapping: q.datasetDefinition,
+		metrics:     newOpMetrics(q.metrics, q.logger, q.datasetDefinition.DatasetName, "iterate"),
+		span:        iterSpan,
+		requestSpan: trace.SpanFromContext(ctx),
+		start:       time.Now(),
+		queryID:     id,
+		logger:      q.logger,
+		mapping:     q.datasetDefinition,
 		release: func() {
 			if rows != nil {
 				rows.Close()
 			}
 			releaseConn()
 		},
-		token:    q.token,
-		rows:     rows,
-		colTypes: colTypes,
-		mapper:   mapper,
-		rowBuf:   make([]any, len(colTypes)),
+		token:          q.token,
+		rows:           rows,
+		colTypes:       colTypes,
+		semiStructured: semiStructuredColumns(colTypes, q.datasetDefinition.OutgoingMappingConfig),
+		mapper:         mapper,
+		rowBuf:         make([]any, len(colTypes)),
 	}, nil
 }
 
@@ -177,11 +295,33 @@ type entIter struct {
 	rows     *sql.Rows
 	mapper   *common.Mapper
 	colTypes []*sql.ColumnType
-	rowBuf   []any
+	// columns that hold json text, parsed into nested values before mapping
+	semiStructured []bool
+	rowBuf         []any
+	// row count and duration are reported when the iterator is closed
+	metrics *opMetrics
+	start   time.Time
+	read    int64
+	closed  bool
+	// the iteration span and the span of the request are ended when the iterator is closed
+	span        trace.Span
+	requestSpan trace.Span
+	err         error
+	// snowflake query id of rows, logged with errors
+	queryID string
 }
 
 // Close implements common_datalayer.EntityIterator.
 func (i *entIter) Close() common.LayerError {
+	if !i.closed {
+		i.closed = true
+		i.metrics.gauge("rows", float64(i.read))
+		i.metrics.timing("duration", i.start)
+		for _, span := range []trace.Span{i.span, i.requestSpan} {
+			span.SetAttributes(attribute.Int64("rows", i.read))
+			endSpan(span, i.err)
+		}
+	}
 	i.release()
 	return nil
 }
@@ -194,6 +334,7 @@ func (i *entIter) Context() *egdm.Context {
 // Next implements common_datalayer.EntityIterator.
 func (i *entIter) Next() (*egdm.Entity, common.LayerError) {
 	if i.rows.Next() {
+		i.read++
 		//
 		for x := range i.colTypes {
 			i.rowBuf[x] = new(any)
@@ -201,7 +342,8 @@ func (i *entIter) Next() (*egdm.Entity, common.LayerError) {
 
 		err := i.rows.Scan(i.rowBuf...)
 		if err != nil {
-			i.logger.Error("failed to scan row", "error", err)
+			i.logger.Error("failed to scan row", "error", err, "query_id", i.queryID)
+			i.err = err
 			return nil, common.Err(err, common.LayerErrorInternal)
 		}
 		var jsonEntity string
@@ -212,10 +354,16 @@ func (i *entIter) Next() (*egdm.Entity, common.LayerError) {
 			return entity, nil
 		} else {
 			entity := egdm.NewEntity()
+			if err = parseSemiStructured(i.rowBuf, i.semiStructured, i.colTypes, i.baseURI()); err != nil {
+				i.logger.Error("failed to parse row", "error", err, "query_id", i.queryID)
+				i.err = err
+				return nil, common.Err(err, common.LayerErrorInternal)
+			}
 			ri := rowItem(i.rowBuf, i.colTypes)
 			err = i.mapper.MapItemToEntity(ri, entity)
 			if err != nil {
-				i.logger.Error("failed to map row", "error", err, "row", fmt.Sprintf("%+v", ri))
+				i.logger.Error("failed to map row", "error", err, "row", fmt.Sprintf("%+v", ri), "query_id", i.queryID)
+				i.err = err
 				return nil, common.Err(err, common.LayerErrorInternal)
 			}
 			return entity, nil
@@ -224,13 +372,22 @@ func (i *entIter) Next() (*egdm.Entity, common.LayerError) {
 	} else {
 		// exhausted or failed
 		if i.rows.Err() != nil {
-			i.logger.Error("failed to read rows", "error", i.rows.Err())
+			i.logger.Error("failed to read rows", "error", i.rows.Err(), "query_id", i.queryID)
+			i.metrics.incr("errors")
+			i.err = i.rows.Err()
 			return nil, common.Err(i.rows.Err(), common.LayerErrorInternal)
 		}
 		return nil, nil
 	}
 }
 
+func (i *entIter) baseURI() string {
+	if i.mapping.OutgoingMappingConfig == nil {
+		return ""
+	}
+	return i.mapping.OutgoingMappingConfig.BaseURI
+}
+
 // Token implements common_datalayer.EntityIterator.
 func (i *entIter) Token() (*egdm.Continuation, common.LayerError) {
 	c := egdm.NewContinuation()
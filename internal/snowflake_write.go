@@ -19,48 +19,83 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
 	gsf "github.com/snowflakedb/gosnowflake"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func (sf *SfDB) putEntities(ctx context.Context, datasetName string, stage string, entities []*egdm.Entity) ([]string, error) {
+// BatchControlTable records the keys of loaded incremental batches per dataset
+const BatchControlTable = "DATALAYER_LOADED_BATCHES"
+
+const defaultBatchKeyTTL = 7 * 24 * time.Hour
+
+// putEntities uploads one batch of entities as gzipped files to the stage. The batch is split
+// into several files when it exceeds the max_file_bytes of lc.
+func (sf *SfDB) putEntities(ctx context.Context, stage string, entities []*egdm.Entity, datasetDefinition *common.DatasetDefinition, lc *loadConfig) (_ []string, err error) {
+	datasetName := datasetDefinition.DatasetName
+	ctx, span := startSpan(ctx, "snowflake.put", datasetName, attribute.Int("entities", len(entities)))
+	defer func() { endSpan(span, err) }()
+	files := make([]string, 0)
+	var bytes int64
+	for len(entities) > 0 {
+		file, written, size, err := sf.putFile(ctx, stage, entities, datasetName, lc)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+		bytes += size
+		entities = entities[written:]
+	}
+	span.SetAttributes(attribute.Int("files", len(files)), attribute.Int64("bytes", bytes))
+	return files, nil
+}
+
+// putFile writes entities to a temporary file, until the file is full, and uploads it to the stage.
+// It returns the name of the file, the number of entities in it and its compressed size.
+func (sf *SfDB) putFile(ctx context.Context, stage string, entities []*egdm.Entity, datasetName string, lc *loadConfig) (string, int, int64, error) {
 	conn := ctx.Value(Connection).(*sql.Conn)
+	m := sf.op(datasetName, "put")
+	start := time.Now()
 	file, cleanTmpFile, err := sf.NewTmpFile(datasetName)
 	if err != nil {
-		return nil, err
+		return "", 0, 0, err
 	}
 	defer cleanTmpFile()
 
-	err = WriteAsGzippedNDJson(file, entities, datasetName)
+	written, err := WriteAsGzippedNDJson(file, entities, lc.gzipLevel, lc.maxFileBytes)
 	if err != nil {
-		return nil, err
+		return "", 0, 0, err
 	}
 	err = file.Close()
 	if err != nil {
-		return nil, err
+		return "", 0, 0, err
+	}
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		return "", 0, 0, err
 	}
 
 	// then upload to staging
-	files := make([]string, 0)
 	sf.logger.Debug(fmt.Sprintf("Uploading %s", file.Name()))
-	rows, err2 := conn.QueryContext(ctx,
+	rows, err := sf.query(ctx, conn,
 		fmt.Sprintf("PUT file://%s @%s auto_compress=false overwrite=false", file.Name(), stage),
 	)
-	defer func() {
-		if rows != nil {
-			rows.Close()
-		}
-	}()
-	if err2 != nil {
-		return nil, err2
+	if err != nil {
+		m.incr("errors")
+		return "", 0, 0, err
 	}
+	rows.Close()
+	m.timing("duration", start)
+	m.gauge("bytes", float64(info.Size()))
+	m.incr("files")
 
-	files = append(files, filepath.Base(file.Name()))
-	return files, nil
+	return filepath.Base(file.Name()), written, info.Size(), nil
 }
 
 func (sf *SfDB) tableParts(mapping *common.DatasetDefinition) (string, string, string) {
@@ -68,11 +103,11 @@ func (sf *SfDB) tableParts(mapping *common.DatasetDefinition) (string, string, s
 	if ds, ok := mapping.SourceConfig[TableName]; ok {
 		dsName = strings.ToUpper(ds.(string))
 	}
-	dbName := strings.ToUpper(sysConfStr(sf.conf, SnowflakeDB))
+	dbName := strings.ToUpper(confString(sf.conf, SnowflakeDB))
 	if db, ok := mapping.SourceConfig[Database]; ok {
 		dbName = strings.ToUpper(db.(string))
 	}
-	schemaName := strings.ToUpper(sysConfStr(sf.conf, SnowflakeSchema))
+	schemaName := strings.ToUpper(confString(sf.conf, SnowflakeSchema))
 	if schema, ok := mapping.SourceConfig[Schema]; ok {
 		schemaName = strings.ToUpper(schema.(string))
 	}
@@ -105,7 +140,7 @@ func (sf *SfDB) mkStage(ctx context.Context, syncID string, datasetName string,
 			sf.logger.Error("Failed to create multistatement context", "error", err)
 			return "", err
 		}
-		rows, err := conn.QueryContext(mctx, query)
+		rows, err := sf.query(mctx, conn, query)
 
 		defer func() {
 			if rows != nil {
@@ -134,7 +169,7 @@ func (sf *SfDB) mkStage(ctx context.Context, syncID string, datasetName string,
 			}
 			sf.logger.Info("Found previous full sync stage " + existingFsStage + ". Dropping it before new full sync")
 			stmt := fmt.Sprintf("DROP STAGE %s.%s.%s", dbName, schemaName, existingFsStage)
-			_, err = conn.ExecContext(ctx, stmt)
+			_, err = sf.exec(ctx, conn, stmt)
 			if err != nil {
 				sf.logger.Error("Failed to drop previous full sync stage", "error", err, "statement", stmt)
 				return "", err
@@ -146,25 +181,34 @@ func (sf *SfDB) mkStage(ctx context.Context, syncID string, datasetName string,
 	}
 
 	// now create stage
+	if err := sf.createStage(ctx, stage); err != nil {
+		return "", err
+	}
+	return stage, nil
+}
+
+func (sf *SfDB) createStage(ctx context.Context, stage string) error {
+	conn := ctx.Value(Connection).(*sql.Conn)
 	q := fmt.Sprintf(`
 	CREATE STAGE IF NOT EXISTS %s
 		copy_options = (on_error=ABORT_STATEMENT)
 	    file_format = (TYPE='json' STRIP_OUTER_ARRAY = TRUE);
 	`, stage)
 	sf.logger.Debug(q)
-	_, err := conn.ExecContext(ctx, q)
+	_, err := sf.exec(ctx, conn, q)
 	if err != nil {
 		sf.logger.Warn("Failed to create/ensure stage", "query", q)
-		return "", err
 	}
-	return stage, err
+	return err
 }
 
-func (sf *SfDB) loadStage(ctx context.Context, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) error {
+func (sf *SfDB) loadStage(ctx context.Context, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) (err error) {
 	conn := ctx.Value(Connection).(*sql.Conn)
+	ctx, span := startSpan(ctx, "snowflake.load_stage", datasetDefinition.DatasetName)
+	defer func() { endSpan(span, err) }()
 	loadTableName := stage
 
-	_, _, dsName := sf.tableParts(datasetDefinition)
+	dbName, schemaName, dsName := sf.tableParts(datasetDefinition)
 	tableName := dsName
 
 	tx, err := conn.BeginTx(ctx, nil)
@@ -174,17 +218,28 @@ func (sf *SfDB) loadStage(ctx context.Context, stage string, loadTime int64, dat
 	defer func() {
 		_ = tx.Rollback()
 	}()
+	opts, err := tableOptionsOf(datasetDefinition)
+	if err != nil {
+		return err
+	}
+	if _, err = sf.latestStrategy(datasetDefinition); err != nil {
+		return err
+	}
 	colNames, columns, colExtractions, colAssignments, srcColExtractions := ColMappings(datasetDefinition)
+	if sf.HasChangeDetection(datasetDefinition) {
+		colNames, columns, colExtractions, colAssignments, srcColExtractions = WithHashColumn(
+			colNames, columns, colExtractions, colAssignments, srcColExtractions)
+	}
 	// println("\n", smt)
-	if _, err2 := tx.Exec(fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS %s (id varchar, recorded integer, deleted boolean, dataset varchar, %s);`,
-		loadTableName, columns)); err2 != nil {
+	if _, err2 := sf.exec(ctx, tx, fmt.Sprintf(
+		`CREATE %sTABLE IF NOT EXISTS %s (id varchar, recorded integer, deleted boolean, dataset varchar, %s)%s;`,
+		opts.kind(), loadTableName, columns, opts.createClause(false))); err2 != nil {
 		return err2
 	}
-	if sf.HasLatestActive(datasetDefinition) {
-		if _, err2 := tx.Exec(fmt.Sprintf(
-			`CREATE TABLE IF NOT EXISTS %s_LATEST (id varchar, recorded integer, deleted boolean, dataset varchar, %s);`,
-			loadTableName, columns)); err2 != nil {
+	if sf.hasLatestTable(datasetDefinition) {
+		if _, err2 := sf.exec(ctx, tx, fmt.Sprintf(
+			`CREATE %sTABLE IF NOT EXISTS %s_LATEST (id varchar, recorded integer, deleted boolean, dataset varchar, %s)%s;`,
+			opts.kind(), loadTableName, columns, opts.createClause(true))); err2 != nil {
 			return err2
 		}
 	}
@@ -203,11 +258,11 @@ func (sf *SfDB) loadStage(ctx context.Context, stage string, loadTime int64, dat
 	FILE_FORMAT = (TYPE='json' COMPRESSION=GZIP);
 	`, loadTableName, colNames, loadTime, datasetDefinition.DatasetName, colExtractions, stage)
 	// sf.logger.Debug(q)
-	if _, err2 := tx.Query(q); err2 != nil {
+	if err2 := sf.runCounted(ctx, tx, q, datasetDefinition.DatasetName, "copy", copyCounts); err2 != nil {
 		return err2
 	}
 
-	if sf.HasLatestActive(datasetDefinition) {
+	if sf.hasLatestTable(datasetDefinition) {
 		q = fmt.Sprintf(`
 	MERGE INTO %s_LATEST AS latest
 	USING (
@@ -233,55 +288,132 @@ func (sf *SfDB) loadStage(ctx context.Context, stage string, loadTime int64, dat
 `, loadTableName, loadTime, datasetDefinition.DatasetName, colExtractions,
 			stage, colAssignments, colNames, srcColExtractions)
 
-		if _, err := tx.Query(q); err != nil {
+		if err := sf.runCounted(ctx, tx, q, datasetDefinition.DatasetName, "merge", mergeCounts); err != nil {
 			return err
 		}
 	}
-	_, err = tx.Exec(fmt.Sprintf("ALTER STAGE %s RENAME TO %s", stage, stage+"_DONE"))
+	_, err = sf.exec(ctx, tx, fmt.Sprintf("ALTER STAGE %s RENAME TO %s", stage, stage+"_DONE"))
 	if err != nil {
 		return err
 	}
 	sf.logger.Debug(fmt.Sprintf("Done with %s. now swapping with %s", loadTableName, tableName))
-	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s SWAP WITH %s", loadTableName, tableName))
+	swap := sf.op(datasetDefinition.DatasetName, "swap")
+	_, swapSpan := startSpan(ctx, "snowflake.swap", datasetDefinition.DatasetName)
+	defer func() { endSpan(swapSpan, err) }()
+	swapStart := time.Now()
+	// the swap fails if the table does not exist yet, which is expected and not logged
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s SWAP WITH %s", loadTableName, tableName))
 	if err != nil {
 		// if swap fails, this could be the first full sync and tableName does not exist yet. so try rename
-		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", loadTableName, tableName))
+		_, err = sf.exec(ctx, tx, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", loadTableName, tableName))
 		if err != nil {
 			return err
 		}
 	} else {
 		// if swap was success, remove load table (which is now the old table)
-		_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s", loadTableName))
+		_, err = sf.exec(ctx, tx, fmt.Sprintf("DROP TABLE %s", loadTableName))
 		if err != nil {
 			return err
 		}
 	}
 
-	if sf.HasLatestActive(datasetDefinition) {
-		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s_LATEST SWAP WITH %s_LATEST", loadTableName, tableName))
+	if sf.hasLatestTable(datasetDefinition) {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s_LATEST SWAP WITH %s_LATEST", loadTableName, tableName))
 		if err != nil {
 			// if swap fails, this could be the first full sync and tableName does not exist yet. so try rename
-			_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s_LATEST RENAME TO %s_LATEST", loadTableName, tableName))
+			_, err = sf.exec(ctx, tx, fmt.Sprintf("ALTER TABLE %s_LATEST RENAME TO %s_LATEST", loadTableName, tableName))
 			if err != nil {
 				return err
 			}
 		} else {
 			// if swap was success, remove load table (which is now the old table)
-			_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s_LATEST", loadTableName))
+			_, err = sf.exec(ctx, tx, fmt.Sprintf("DROP TABLE %s_LATEST", loadTableName))
 			if err != nil {
 				return err
 			}
 		}
 	}
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		swap.incr("errors")
+		return err
+	}
+	swap.timing("duration", swapStart)
+	swap.incr("completed")
+
+	if sf.hasLatestView(datasetDefinition) {
+		// the base table only exists after the first swap, and the view resolves it by name.
+		// creating it is DDL, which would commit the swap early, so it runs after the transaction
+		if err = sf.ensureLatestView(ctx, conn, fmt.Sprintf("%s.%s.%s", dbName, schemaName, tableName), datasetDefinition); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (sf *SfDB) loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) error {
+// loadFilesInStage copies files into the dataset table, at most lc.maxFilesPerCopy files per COPY INTO
+func (sf *SfDB) loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition, lc *loadConfig) (err error) {
 	conn := ctx.Value(Connection).(*sql.Conn)
+	ctx, span := startSpan(ctx, "snowflake.load_files", datasetDefinition.DatasetName, attribute.Int("files", len(files)))
+	defer func() { endSpan(span, err) }()
 	dbName, schemaName, dsName := sf.tableParts(datasetDefinition)
 	nameSpace := fmt.Sprintf("%s.%s", dbName, schemaName)
 	tableName := dsName
 
+	opts, err := tableOptionsOf(datasetDefinition)
+	if err != nil {
+		return err
+	}
+	if _, err = sf.latestStrategy(datasetDefinition); err != nil {
+		return err
+	}
+	if _, err = sf.ingestMode(datasetDefinition); err != nil {
+		return err
+	}
+	changeDetection := sf.HasChangeDetection(datasetDefinition)
+	colNames, columns, colExtractions, colAssignments, srcColExtractions := ColMappings(datasetDefinition)
+	if changeDetection {
+		colNames, columns, colExtractions, colAssignments, srcColExtractions = WithHashColumn(
+			colNames, columns, colExtractions, colAssignments, srcColExtractions)
+	}
+	// DDL commits the open transaction in snowflake, so the tables are set up before the load transaction
+	if _, err := sf.exec(ctx, conn, fmt.Sprintf(`
+	CREATE %sTABLE IF NOT EXISTS %s.%s ( id varchar, recorded integer, deleted boolean, dataset varchar, %s )%s;
+	`, opts.kind(), nameSpace, tableName, columns, opts.createClause(false))); err != nil {
+		return err
+	}
+	if err := sf.reconcileTableOptions(ctx, conn, nameSpace+"."+tableName, opts, false); err != nil {
+		return err
+	}
+
+	if sf.hasLatestTable(datasetDefinition) {
+		if _, err := sf.exec(ctx, conn, fmt.Sprintf(`
+	CREATE %sTABLE IF NOT EXISTS %s.%s_LATEST ( id varchar, recorded integer, deleted boolean, dataset varchar, %s )%s;
+	`, opts.kind(), nameSpace, tableName, columns, opts.createClause(true))); err != nil {
+			return err
+		}
+		if err := sf.reconcileTableOptions(ctx, conn, nameSpace+"."+tableName+"_LATEST", opts, true); err != nil {
+			return err
+		}
+	}
+
+	if sf.hasLatestView(datasetDefinition) {
+		if err := sf.ensureLatestView(ctx, conn, nameSpace+"."+tableName, datasetDefinition); err != nil {
+			return err
+		}
+	}
+	if changeDetection {
+		// tables created before change detection was enabled lack the hash column
+		if err := sf.ensureHashColumn(ctx, conn, nameSpace, tableName, datasetDefinition); err != nil {
+			return err
+		}
+	}
+	batchKey, _ := ctx.Value(BatchKey).(string)
+	if batchKey != "" {
+		if err := sf.ensureBatchControlTable(ctx, conn, nameSpace); err != nil {
+			return err
+		}
+	}
+
 	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -290,24 +422,29 @@ func (sf *SfDB) loadFilesInStage(ctx context.Context, files []string, stage stri
 		_ = tx.Rollback()
 	}()
 
-	colNames, columns, colExtractions, colAssignments, srcColExtractions := ColMappings(datasetDefinition)
-	if _, err := tx.Exec(fmt.Sprintf(`
-	CREATE TABLE IF NOT EXISTS %s.%s ( id varchar, recorded integer, deleted boolean, dataset varchar, %s );
-	`, nameSpace, tableName, columns)); err != nil {
-		return err
-	}
-
-	if sf.HasLatestActive(datasetDefinition) {
-		if _, err := tx.Exec(fmt.Sprintf(`
-	CREATE TABLE IF NOT EXISTS %s.%s_LATEST ( id varchar, recorded integer, deleted boolean, dataset varchar, %s );
-	`, nameSpace, tableName, columns)); err != nil {
+	// if the batch has a key, skip it when it has been loaded before. this makes client retries safe
+	if batchKey != "" {
+		claimed, err := sf.claimBatch(ctx, tx, nameSpace, datasetDefinition.DatasetName, batchKey, loadTime)
+		if err != nil {
 			return err
 		}
+		if !claimed {
+			sf.logger.Info("Batch already loaded, skipping replay", "dataset", datasetDefinition.DatasetName, "batch", batchKey)
+			return tx.Commit()
+		}
 	}
 	fileString := "'" + strings.Join(files, "', '") + "'"
 
 	sf.logger.Debug(fmt.Sprintf("Loading %s", fileString))
-	q := fmt.Sprintf(`
+	if changeDetection {
+		q := sf.changedEntitiesInsert(nameSpace, tableName, files, stage, loadTime, datasetDefinition, colNames, colExtractions)
+		if err := sf.runCounted(ctx, tx, q, datasetDefinition.DatasetName, "insert", insertCounts); err != nil {
+			return err
+		}
+	} else {
+		// the FILES option takes a limited number of files, so large batches are copied in several statements
+		for _, chunk := range chunks(files, lc.maxFilesPerCopy) {
+			q := fmt.Sprintf(`
 	COPY INTO %s.%s(id, recorded, deleted, dataset, %s)
 	    FROM (
 	    	SELECT
@@ -319,14 +456,17 @@ func (sf *SfDB) loadFilesInStage(ctx context.Context, files []string, stage stri
 	    	FROM @%s)
 	FILE_FORMAT = (TYPE='json' COMPRESSION=GZIP)
 	FILES = (%s);
-	`, nameSpace, tableName, colNames, loadTime, datasetDefinition.DatasetName, colExtractions, stage, fileString)
+	`, nameSpace, tableName, colNames, loadTime, datasetDefinition.DatasetName, colExtractions, stage,
+				"'"+strings.Join(chunk, "', '")+"'")
 
-	if _, err := tx.Query(q); err != nil {
-		return err
+			if err := sf.runCounted(ctx, tx, q, datasetDefinition.DatasetName, "copy", copyCounts); err != nil {
+				return err
+			}
+		}
 	}
 
-	if sf.HasLatestActive(datasetDefinition) {
-		q = fmt.Sprintf(`
+	if sf.hasLatestTable(datasetDefinition) {
+		q := fmt.Sprintf(`
 	MERGE INTO %s.%s_LATEST AS latest
 	USING (
 		SELECT
@@ -350,9 +490,124 @@ func (sf *SfDB) loadFilesInStage(ctx context.Context, files []string, stage stri
 		VALUES (src.id, src.recorded, src.deleted, src.dataset, %s);
 `, nameSpace, tableName, loadTime, datasetDefinition.DatasetName, colExtractions,
 			stage, strings.Join(files, "|"), colAssignments, colNames, srcColExtractions)
-		if _, err := tx.Query(q); err != nil {
+		if err := sf.runCounted(ctx, tx, q, datasetDefinition.DatasetName, "merge", mergeCounts); err != nil {
 			return err
 		}
 	}
+
 	return tx.Commit()
 }
+
+// ensureBatchControlTable creates the batch control table in nameSpace, once per process. This is DDL,
+// which commits the open transaction in snowflake, so it runs on the connection before the load starts.
+func (sf *SfDB) ensureBatchControlTable(ctx context.Context, conn *sql.Conn, nameSpace string) error {
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (dataset varchar, batch_key varchar, recorded integer);",
+		nameSpace, BatchControlTable)
+	if _, done := sf.reconciledTables.Load(stmt); done {
+		return nil
+	}
+	if _, err := sf.exec(ctx, conn, stmt); err != nil {
+		return err
+	}
+	sf.reconciledTables.Store(stmt, true)
+	return nil
+}
+
+// claimBatch records the batch key in tx. It returns false if the key was recorded within batch_key_ttl
+// before. The key is claimed with a MERGE before the load, instead of being checked first and inserted after
+// the load: MERGE locks the control table until tx ends, so a concurrent replay of the same batch waits for
+// the first load and then finds its key. If the load fails, the rollback of tx removes the key again.
+// Expired keys of the dataset are deleted in the same transaction.
+func (sf *SfDB) claimBatch(ctx context.Context, tx *sql.Tx, nameSpace string, datasetName string, batchKey string, loadTime int64) (bool, error) {
+	expiry := loadTime - confDuration(sf.conf, BatchKeyTTL).Nanoseconds()
+	if _, err := sf.exec(ctx, tx, fmt.Sprintf("DELETE FROM %s.%s WHERE dataset = ? AND recorded < ?;",
+		nameSpace, BatchControlTable), datasetName, expiry); err != nil {
+		return false, err
+	}
+	res, err := sf.exec(ctx, tx, fmt.Sprintf(
+		"MERGE INTO %s.%s AS b USING (SELECT ? AS dataset, ? AS batch_key) AS k "+
+			"ON b.dataset = k.dataset AND b.batch_key = k.batch_key "+
+			"WHEN NOT MATCHED THEN INSERT (dataset, batch_key, recorded) VALUES (k.dataset, k.batch_key, ?);",
+		nameSpace, BatchControlTable), datasetName, batchKey, loadTime)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted > 0, nil
+}
+
+func (sf *SfDB) ensureHashColumn(ctx context.Context, conn *sql.Conn, nameSpace string, tableName string, datasetDefinition *common.DatasetDefinition) error {
+	if _, err := sf.exec(ctx, conn, fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS hash varchar;", nameSpace, tableName)); err != nil {
+		return err
+	}
+	if sf.hasLatestTable(datasetDefinition) {
+		if _, err := sf.exec(ctx, conn, fmt.Sprintf("ALTER TABLE %s.%s_LATEST ADD COLUMN IF NOT EXISTS hash varchar;", nameSpace, tableName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureLatestView creates the latest view or dynamic table on top of the given base table,
+// once per process. Existing objects are not replaced. The statement is DDL, so it must not run inside a load transaction.
+func (sf *SfDB) ensureLatestView(ctx context.Context, conn *sql.Conn, table string, datasetDefinition *common.DatasetDefinition) error {
+	strategy, err := sf.latestStrategy(datasetDefinition)
+	if err != nil {
+		return err
+	}
+	latestQuery := fmt.Sprintf(
+		"SELECT * FROM %s QUALIFY ROW_NUMBER() OVER (PARTITION BY id ORDER BY recorded DESC) = 1", table)
+	stmt := fmt.Sprintf("CREATE VIEW IF NOT EXISTS %s_LATEST AS %s;", table, latestQuery)
+	if strategy == LatestStrategyDynamicTable {
+		lag := "1 minute"
+		if v, ok := datasetDefinition.SourceConfig[LatestTargetLag].(string); ok && v != "" {
+			lag = v
+		}
+		stmt = fmt.Sprintf("CREATE DYNAMIC TABLE IF NOT EXISTS %s_LATEST TARGET_LAG = %s WAREHOUSE = %s AS %s;",
+			table, sqlString(lag), confString(sf.conf, SnowflakeWarehouse), latestQuery)
+	}
+	if _, done := sf.reconciledTables.Load(stmt); done {
+		return nil
+	}
+	sf.logger.Debug(stmt)
+	if _, err := sf.exec(ctx, conn, stmt); err != nil {
+		return err
+	}
+	sf.reconciledTables.Store(stmt, true)
+	return nil
+}
+
+// changedEntitiesInsert builds an insert statement that replaces COPY INTO when change detection is active.
+// Only the latest version of each entity in the given files is considered, and it is only appended
+// if its hash differs from the hash of the latest version already stored.
+func (sf *SfDB) changedEntitiesInsert(nameSpace string, tableName string, files []string, stage string, loadTime int64,
+	datasetDefinition *common.DatasetDefinition, colNames string, colExtractions string,
+) string {
+	// compare with the latest table if we have one, otherwise find the latest row per id in the base table
+	current := fmt.Sprintf(
+		"(SELECT id, hash FROM %s.%s QUALIFY ROW_NUMBER() OVER (PARTITION BY id ORDER BY recorded DESC) = 1)",
+		nameSpace, tableName)
+	if sf.hasLatestTable(datasetDefinition) {
+		current = fmt.Sprintf("%s.%s_LATEST", nameSpace, tableName)
+	}
+	return fmt.Sprintf(`
+	INSERT INTO %s.%s(id, recorded, deleted, dataset, %s)
+	SELECT src.id, src.recorded, src.deleted, src.dataset, %s
+	FROM (
+		SELECT
+		$1:id::varchar as id,
+		%v::integer as recorded,
+		coalesce($1:deleted::boolean, false) as deleted,
+		'%s'::varchar as dataset,
+		%s
+		FROM (SELECT $1, METADATA$FILE_ROW_NUMBER AS ix, METADATA$FILE_LAST_MODIFIED AS fts FROM @%s (PATTERN => '.*(%s)'))
+		QUALIFY ROW_NUMBER() OVER (PARTITION BY id ORDER BY $1:recorded DESC, fts DESC, ix DESC) = 1
+	) AS src
+	LEFT JOIN %s AS cur ON cur.id = src.id
+	WHERE cur.hash IS NULL OR cur.hash <> src.hash;
+`, nameSpace, tableName, colNames, srcColumns(colNames), loadTime, datasetDefinition.DatasetName, colExtractions,
+		stage, strings.Join(files, "|"), current)
+}
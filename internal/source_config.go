@@ -0,0 +1,246 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+// identifierPattern matches unquoted snowflake identifiers. The layer never quotes identifiers.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// dataTypePattern splits a snowflake data type into its name and optional precision, e.g. NUMBER(38, 0)
+var dataTypePattern = regexp.MustCompile(`^([A-Za-z_]+(?: [A-Za-z_]+)?)\s*(\(\s*\d+\s*(,\s*\d+\s*)?\))?$`)
+
+// snowflakeTypes are the column types allowed in incoming property mappings
+var snowflakeTypes = map[string]bool{
+	"string": true, "varchar": true, "text": true, "char": true, "character": true,
+	"number": true, "numeric": true, "decimal": true, "int": true, "integer": true, "bigint": true,
+	"smallint": true, "tinyint": true, "byteint": true,
+	"float": true, "float4": true, "float8": true, "double": true, "double precision": true, "real": true,
+	"boolean": true, "date": true, "datetime": true, "time": true, "timestamp": true,
+	"timestamp_ltz": true, "timestamp_ntz": true, "timestamp_tz": true,
+	"variant": true, "object": true, "array": true, "binary": true, "varbinary": true,
+	"geography": true, "geometry": true,
+}
+
+// outgoingTypes maps the supported outgoing datatypes to the snowflake type their column is cast to when read.
+// variant, object and array columns are parsed into nested values by the layer, the others are converted by
+// the common-datalayer mapper.
+var outgoingTypes = map[string]string{
+	"": "", "integer": "INTEGER", "int": "INTEGER", "long": "BIGINT", "float": "DOUBLE", "double": "DOUBLE",
+	"bool": "BOOLEAN", "string": "VARCHAR", "variant": "VARIANT", "object": "OBJECT", "array": "ARRAY",
+}
+
+// sourceConfig is the typed form of a dataset source_config
+type sourceConfig struct {
+	tableName         string
+	schema            string
+	database          string
+	rawColumn         string
+	sinceColumn       string
+	latestTable       *bool
+	latestStrategy    string
+	latestTargetLag   string
+	changeDetection   bool
+	idempotentBatches bool
+	ingestMode        string
+	tableOptions      *tableOptions
+	allowRead         bool
+	allowWrite        bool
+	where             string
+	filterColumns     []string
+	query             string
+	queryParams       []any
+	// nil if not set
+	maxConcurrentRequests *int
+}
+
+// parseSourceConfig reads a source_config map into its typed form.
+// All type errors are collected, so that a config can be fixed in one go.
+func parseSourceConfig(definition *common.DatasetDefinition) (*sourceConfig, error) {
+	sc := definition.SourceConfig
+	res := &sourceConfig{allowRead: true, allowWrite: true}
+	var errs []error
+	str := func(key string, dst *string) {
+		if v, ok := sc[key]; ok {
+			s, ok := v.(string)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s must be a string, got %T", key, v))
+				return
+			}
+			*dst = s
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v, ok := sc[key]; ok {
+			b, ok := v.(bool)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s must be a boolean, got %T", key, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	str(TableName, &res.tableName)
+	str(Schema, &res.schema)
+	str(Database, &res.database)
+	str(RawColumn, &res.rawColumn)
+	str(SinceColumn, &res.sinceColumn)
+	str(LatestStrategy, &res.latestStrategy)
+	str(LatestTargetLag, &res.latestTargetLag)
+	str(IngestMode, &res.ingestMode)
+	boolean(ChangeDetection, &res.changeDetection)
+	boolean(IdempotentBatches, &res.idempotentBatches)
+	boolean(AllowRead, &res.allowRead)
+	str(Where, &res.where)
+	str(Query, &res.query)
+	if v, ok := sc[QueryParams]; ok {
+		if l, ok := v.([]any); ok {
+			res.queryParams = l
+		} else {
+			errs = append(errs, fmt.Errorf("%s must be a list, got %T", QueryParams, v))
+		}
+	}
+	if v, ok := sc[FilterColumns]; ok {
+		l, err := stringList(v, FilterColumns)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		res.filterColumns = l
+	}
+	boolean(AllowWrite, &res.allowWrite)
+	if v, ok := sc[MaxConcurrentRequests]; ok {
+		if n, ok := asInt(v); ok && n >= 0 {
+			res.maxConcurrentRequests = &n
+		} else {
+			errs = append(errs, fmt.Errorf("%s must be a non-negative integer, got %v", MaxConcurrentRequests, v))
+		}
+	}
+	if _, ok := sc[LatestTable]; ok {
+		var b bool
+		boolean(LatestTable, &b)
+		res.latestTable = &b
+	}
+	opts, err := tableOptionsOf(definition)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	res.tableOptions = opts
+	return res, errors.Join(errs...)
+}
+
+// validateDatasetDefinitions checks all dataset definitions, and reports all problems in one error.
+func validateDatasetDefinitions(conf *common.Config, definitions []*common.DatasetDefinition) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, definition := range definitions {
+		if definition == nil {
+			errs = append(errs, fmt.Errorf("dataset_definitions[%d] is empty", i))
+			continue
+		}
+		if seen[definition.DatasetName] {
+			errs = append(errs, fmt.Errorf("dataset %s is defined more than once", definition.DatasetName))
+		}
+		seen[definition.DatasetName] = true
+		if err := validateDatasetDefinition(conf, definition); err != nil {
+			errs = append(errs, fmt.Errorf("dataset %s:\n  %s", definition.DatasetName,
+				strings.ReplaceAll(err.Error(), "\n", "\n  ")))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid dataset_definitions:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func validateDatasetDefinition(conf *common.Config, definition *common.DatasetDefinition) error {
+	var errs []error
+	if definition.DatasetName == "" {
+		errs = append(errs, fmt.Errorf("missing dataset name"))
+	}
+	sc, err := parseSourceConfig(definition)
+	if err != nil {
+		// the remaining checks assume correctly typed values
+		return errors.Join(append(errs, err)...)
+	}
+
+	identifier := func(key, value string) {
+		if value != "" && !identifierPattern.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s %q is not a valid snowflake identifier", key, value))
+		}
+	}
+	identifier(Database, sc.database)
+	identifier(Schema, sc.schema)
+	identifier(RawColumn, sc.rawColumn)
+	identifier(SinceColumn, sc.sinceColumn)
+	for _, c := range sc.filterColumns {
+		identifier(FilterColumns, c)
+	}
+	if sc.tableName != "" {
+		identifier(TableName, sc.tableName)
+	} else if definition.DatasetName != "" && sc.query == "" {
+		identifier("table name derived from dataset name", strings.ReplaceAll(definition.DatasetName, ".", "_"))
+	}
+
+	sf := &SfDB{conf: conf}
+	if _, err := sf.latestStrategy(definition); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := sf.ingestMode(definition); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := loadConfigOf(conf, definition.SourceConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateQuery(sc); err != nil {
+		errs = append(errs, err)
+	}
+
+	if m := definition.IncomingMappingConfig; m != nil {
+		for _, pm := range m.PropertyMappings {
+			identifier("incoming property", pm.Property)
+			if pm.Property == "" {
+				errs = append(errs, fmt.Errorf("incoming property mapping for %q has no property (column) name", pm.EntityProperty))
+			}
+			if pm.Custom != nil && pm.Custom["expression"] != nil && pm.Datatype == "" {
+				errs = append(errs, fmt.Errorf("incoming property %s has a custom expression, but no datatype", pm.Property))
+			}
+			if pm.Datatype != "" && !validSnowflakeType(pm.Datatype) {
+				errs = append(errs, fmt.Errorf("incoming property %s has unsupported datatype %q", pm.Property, pm.Datatype))
+			}
+		}
+	}
+	if m := definition.OutgoingMappingConfig; m != nil {
+		for _, pm := range m.PropertyMappings {
+			if _, ok := outgoingTypes[pm.Datatype]; !ok {
+				errs = append(errs, fmt.Errorf("outgoing property %s has unsupported datatype %q", pm.Property, pm.Datatype))
+			} else if semiStructuredTypes[outgoingTypes[pm.Datatype]] && (pm.IsIdentity || pm.IsReference) {
+				errs = append(errs, fmt.Errorf("outgoing property %s is an identity or reference, and cannot have datatype %q", pm.Property, pm.Datatype))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validSnowflakeType(t string) bool {
+	m := dataTypePattern.FindStringSubmatch(strings.TrimSpace(t))
+	return m != nil && snowflakeTypes[strings.ToLower(m[1])]
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	common "github.com/mimiro-io/common-datalayer"
+)
+
+var tagNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$.]*$`)
+
+// clusterKeyPattern matches the clustering keys the layer accepts: a column, or a function of columns and
+// literals, e.g. to_date(recorded) or substr(id, 1, 4). Keys are pasted into CLUSTER BY (...) statements.
+var clusterKeyPattern = regexp.MustCompile(`^` + clusterKeyTerm + `(\(\s*` + clusterKeyArg + `(\s*,\s*` + clusterKeyArg + `)*\s*\))?$`)
+
+const (
+	clusterKeyTerm = `[A-Za-z_][A-Za-z0-9_$]*`
+	clusterKeyArg  = `(` + clusterKeyTerm + `|-?\d+|'[^'\\]*')`
+)
+
+type tableOptions struct {
+	clusterBy       []string
+	latestClusterBy []string
+	transient       bool
+	retentionDays   *int
+	comment         string
+	tags            map[string]string
+}
+
+// tableOptionsOf reads the table options from the dataset source config.
+func tableOptionsOf(definition *common.DatasetDefinition) (*tableOptions, error) {
+	opts := &tableOptions{}
+	sc := definition.SourceConfig
+	var err error
+	if opts.clusterBy, err = stringList(sc[ClusterBy], ClusterBy); err != nil {
+		return nil, err
+	}
+	if opts.latestClusterBy, err = stringList(sc[LatestClusterBy], LatestClusterBy); err != nil {
+		return nil, err
+	}
+	if opts.latestClusterBy == nil {
+		opts.latestClusterBy = opts.clusterBy
+	}
+	for _, keys := range []struct {
+		key  string
+		keys []string
+	}{{ClusterBy, opts.clusterBy}, {LatestClusterBy, opts.latestClusterBy}} {
+		for _, k := range keys.keys {
+			if !clusterKeyPattern.MatchString(k) {
+				return nil, fmt.Errorf("%s %q must be a column or a function of columns, e.g. to_date(recorded)", keys.key, k)
+			}
+		}
+	}
+	if v, ok := sc[Transient]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a boolean, got %T", Transient, v)
+		}
+		opts.transient = b
+	}
+	if v, ok := sc[DataRetentionDays]; ok {
+		var days int
+		switch n := v.(type) {
+		case float64:
+			days = int(n)
+			if float64(days) != n {
+				return nil, fmt.Errorf("%s must be a whole number, got %v", DataRetentionDays, v)
+			}
+		case int:
+			days = n
+		default:
+			return nil, fmt.Errorf("%s must be a number, got %T", DataRetentionDays, v)
+		}
+		if days < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %v", DataRetentionDays, days)
+		}
+		opts.retentionDays = &days
+	}
+	if v, ok := sc[TableComment]; ok {
+		c, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string, got %T", TableComment, v)
+		}
+		opts.comment = c
+	}
+	if v, ok := sc[TableTags]; ok {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object, got %T", TableTags, v)
+		}
+		opts.tags = map[string]string{}
+		for k, tv := range m {
+			if !tagNamePattern.MatchString(k) {
+				return nil, fmt.Errorf("%s contains invalid tag name %q", TableTags, k)
+			}
+			s, ok := tv.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s value for %s must be a string, got %T", TableTags, k, tv)
+			}
+			opts.tags[k] = s
+		}
+	}
+	return opts, nil
+}
+
+func stringList(v any, key string) ([]string, error) {
+	switch l := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{l}, nil
+	case []string:
+		return l, nil
+	case []any:
+		res := make([]string, len(l))
+		for i, e := range l {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings, got %T element", key, e)
+			}
+			res[i] = s
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("%s must be a string or a list of strings, got %T", key, v)
+	}
+}
+
+// kind returns the table type prefix for create table statements.
+func (o *tableOptions) kind() string {
+	if o.transient {
+		return "TRANSIENT "
+	}
+	return ""
+}
+
+func (o *tableOptions) clusterKeys(latest bool) []string {
+	if latest {
+		return o.latestClusterBy
+	}
+	return o.clusterBy
+}
+
+// createClause returns the options to append to a create table statement.
+func (o *tableOptions) createClause(latest bool) string {
+	clause := ""
+	if keys := o.clusterKeys(latest); len(keys) > 0 {
+		clause = fmt.Sprintf("%s CLUSTER BY (%s)", clause, strings.Join(keys, ", "))
+	}
+	if o.retentionDays != nil {
+		clause = fmt.Sprintf("%s DATA_RETENTION_TIME_IN_DAYS = %d", clause, *o.retentionDays)
+	}
+	if len(o.tags) > 0 {
+		clause = fmt.Sprintf("%s WITH TAG (%s)", clause, o.tagList())
+	}
+	if o.comment != "" {
+		clause = fmt.Sprintf("%s COMMENT = %s", clause, sqlString(o.comment))
+	}
+	return clause
+}
+
+// alterStatements returns the statements needed to bring an existing table in line with the options.
+// Transient is left out, since snowflake cannot change the type of an existing table.
+func (o *tableOptions) alterStatements(table string, latest bool) []string {
+	var stmts []string
+	if keys := o.clusterKeys(latest); len(keys) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s CLUSTER BY (%s);", table, strings.Join(keys, ", ")))
+	}
+	if o.retentionDays != nil {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s SET DATA_RETENTION_TIME_IN_DAYS = %d;", table, *o.retentionDays))
+	}
+	if o.comment != "" {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s SET COMMENT = %s;", table, sqlString(o.comment)))
+	}
+	if len(o.tags) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s SET TAG %s;", table, o.tagList()))
+	}
+	return stmts
+}
+
+func (o *tableOptions) tagList() string {
+	names := make([]string, 0, len(o.tags))
+	for k := range o.tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	tags := make([]string, len(names))
+	for i, k := range names {
+		tags[i] = fmt.Sprintf("%s = %s", k, sqlString(o.tags[k]))
+	}
+	return strings.Join(tags, ", ")
+}
+
+// reconcileTableOptions applies the table options to existing tables. This is done once per table
+// and option set for the lifetime of the process, so that repeated incremental writes do not pay for it.
+// ALTER TABLE commits the open transaction in snowflake, so it runs on the connection before a load starts,
+// and the option set is only recorded when the statements have succeeded.
+func (sf *SfDB) reconcileTableOptions(ctx context.Context, conn *sql.Conn, table string, opts *tableOptions, latest bool) error {
+	stmts := opts.alterStatements(table, latest)
+	if len(stmts) == 0 {
+		return nil
+	}
+	key := table + ":" + strings.Join(stmts, "")
+	if _, done := sf.reconciledTables.Load(key); done {
+		return nil
+	}
+	for _, stmt := range stmts {
+		sf.logger.Debug(stmt)
+		if _, err := sf.exec(ctx, conn, stmt); err != nil {
+			return err
+		}
+	}
+	sf.reconciledTables.Store(key, true)
+	return nil
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
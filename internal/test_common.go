@@ -19,19 +19,28 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	common "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // TODO: provide mocks in common-datalayer?
 type (
 	testMetrics struct {
+		mu      sync.Mutex
 		metrics map[string]any
+		tags    map[string][]string
 	}
 	testLogger struct {
+		mu   sync.Mutex
 		logs []string
 	}
 	testDB struct {
@@ -54,6 +63,17 @@ type (
 	}
 )
 
+// withTmpFiles lets puts write entity files to new temp files, which are removed after each put
+func (tdb *testDB) withTmpFiles() {
+	tdb.NewTmpFile = func(ds string) (*os.File, func(), error) {
+		f, err := os.CreateTemp("", "zip")
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { os.Remove(f.Name()) }, nil
+	}
+}
+
 func (tdb *testDB) close() error {
 	return tdb.db.Close()
 }
@@ -94,6 +114,11 @@ func (q *testQuery) withLimit(limit int) (query, error) {
 	return q.sfQ.withLimit(limit)
 }
 
+// withFilters implements query.
+func (q *testQuery) withFilters(where string, filters []filter) (query, error) {
+	return q.sfQ.withFilters(where, filters)
+}
+
 // withSince implements query.
 func (q *testQuery) withSince(sinceColumn string, sinceToken string) (query, error) {
 	q.sinceColumn = sinceColumn
@@ -106,19 +131,28 @@ func newTestDB(cnt int, conf *common.Config, logger common.Logger, metrics commo
 	if err != nil {
 		return nil, err
 	}
-	mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec("USE SECONDARY ROLES ALL;").WillReturnResult(sqlmock.NewResult(1, 1))
-	sfDB, err := newSfDB(conf, logger, metrics)
+	sfDB, err := newSfDB(conf, logger, metrics, FileSecretProvider{})
 	if err != nil {
 		return nil, err
 	}
 	sfDB.db = dbNew
-	return &testDB{db: dbNew, mock: mock, sfDB: sfDB}, err
+	tdb := &testDB{db: dbNew, mock: mock, sfDB: sfDB}
+	tdb.ExpectConn()
+	return tdb, err
 }
 
+// ExpectConn expects the session setup of a new layer session
 func (tdb *testDB) ExpectConn() {
 	tdb.mock.ExpectExec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';").WillReturnResult(sqlmock.NewResult(1, 1))
 	tdb.mock.ExpectExec("USE SECONDARY ROLES ALL;").WillReturnResult(sqlmock.NewResult(1, 1))
+	tdb.mock.ExpectExec("ALTER SESSION SET QUERY_TAG = '\\{.*\\}';").WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// consumeSession runs the session setup expected by ExpectConn, for tests that do not open a layer session
+func (tdb *testDB) consumeSession() {
+	tdb.db.Exec("ALTER SESSION SET GO_QUERY_RESULT_FORMAT = 'JSON';")
+	tdb.db.Exec("USE SECONDARY ROLES ALL;")
+	tdb.db.Exec("ALTER SESSION SET QUERY_TAG = '{}';")
 }
 
 // createQuery implements db.
@@ -129,14 +163,19 @@ func (tdb *testDB) createQuery(ctx context.Context, datasetDefinition *common.Da
 	}, err
 }
 
+// explain implements db.
+func (tdb *testDB) explain(ctx context.Context, conn *sql.Conn, stmt string, args []any) error {
+	return tdb.sfDB.explain(ctx, conn, stmt, args)
+}
+
 // getFsStage implements db.
 func (tdb *testDB) getFsStage(syncId string, datasetDefinition *common.DatasetDefinition) string {
 	return tdb.sfDB.getFsStage(syncId, datasetDefinition)
 }
 
 // loadFilesInStage implements db.
-func (tdb *testDB) loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition) error {
-	return tdb.sfDB.loadFilesInStage(ctx, files, stage, loadTime, datasetDefinition)
+func (tdb *testDB) loadFilesInStage(ctx context.Context, files []string, stage string, loadTime int64, datasetDefinition *common.DatasetDefinition, lc *loadConfig) error {
+	return tdb.sfDB.loadFilesInStage(ctx, files, stage, loadTime, datasetDefinition, lc)
 }
 
 // loadStage implements db.
@@ -149,21 +188,48 @@ func (tdb *testDB) mkStage(ctx context.Context, syncID string, datasetName strin
 	return tdb.sfDB.mkStage(ctx, syncID, datasetName, datasetDefinition)
 }
 
+// mkPipe implements db.
+func (tdb *testDB) mkPipe(ctx context.Context, datasetDefinition *common.DatasetDefinition) (string, string, error) {
+	return tdb.sfDB.mkPipe(ctx, datasetDefinition)
+}
+
+// ingestFiles implements db.
+func (tdb *testDB) ingestFiles(ctx context.Context, pipe string, files []string, datasetDefinition *common.DatasetDefinition) error {
+	return tdb.sfDB.ingestFiles(ctx, pipe, files, datasetDefinition)
+}
+
+// tableParts implements db.
+func (tdb *testDB) tableParts(datasetDefinition *common.DatasetDefinition) (string, string, string) {
+	return tdb.sfDB.tableParts(datasetDefinition)
+}
+
+// discoverTables implements db.
+func (tdb *testDB) discoverTables(ctx context.Context, database string, schemas []string) ([]tableInfo, error) {
+	return tdb.sfDB.discoverTables(ctx, database, schemas)
+}
+
+// tableStats implements db.
+func (tdb *testDB) tableStats(ctx context.Context, datasetDefinition *common.DatasetDefinition) (*tableStats, error) {
+	return tdb.sfDB.tableStats(ctx, datasetDefinition)
+}
+
 // newConnection implements db.
 func (tdb *testDB) newConnection(ctx context.Context) (*sql.Conn, error) {
 	return tdb.db.Conn(ctx)
 }
 
 // putEntities implements db.
-func (tdb *testDB) putEntities(ctx context.Context, datasetName string, stage string, entities []*egdm.Entity) ([]string, error) {
+func (tdb *testDB) putEntities(ctx context.Context, stage string, entities []*egdm.Entity, datasetDefinition *common.DatasetDefinition, lc *loadConfig) ([]string, error) {
 	tdb.sfDB.NewTmpFile = tdb.NewTmpFile
-	return tdb.sfDB.putEntities(ctx, datasetName, stage, entities)
+	return tdb.sfDB.putEntities(ctx, stage, entities, datasetDefinition, lc)
 }
 
 var _ db = &testDB{} // interface assertion
 
 func (l *testLogger) log(message string, level string, args ...any) {
 	msg := fmt.Sprint(append([]any{message, level}, args...))
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.logs = append(l.logs, msg)
 }
 
@@ -193,12 +259,41 @@ func (l *testLogger) With(name string, value string) common.Logger {
 	return l
 }
 
-func (*testMetrics) Gauge(s string, f float64, tags []string, i int) common.LayerError {
-	panic("unimplemented")
+func (m *testMetrics) Gauge(s string, f float64, tags []string, i int) common.LayerError {
+	m.record(s, tags, func(any) any { return f })
+	return nil
+}
+
+func (m *testMetrics) Incr(s string, tags []string, i int) common.LayerError {
+	m.record(s, tags, func(prev any) any {
+		cnt, _ := prev.(int)
+		return cnt + 1
+	})
+	return nil
+}
+
+func (m *testMetrics) Timing(s string, timed time.Duration, tags []string, i int) common.LayerError {
+	m.record(s, tags, func(any) any { return timed })
+	return nil
 }
-func (*testMetrics) Incr(s string, tags []string, i int) common.LayerError { panic("unimplemented") }
-func (*testMetrics) Timing(s string, timed time.Duration, tags []string, i int) common.LayerError {
-	panic("unimplemented")
+
+// record keeps the last value and tags of each metric
+func (m *testMetrics) record(s string, tags []string, value func(prev any) any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.metrics == nil {
+		m.metrics = map[string]any{}
+		m.tags = map[string][]string{}
+	}
+	m.metrics[s] = value(m.metrics[s])
+	m.tags[s] = tags
+}
+
+// get returns the last value of a metric
+func (m *testMetrics) get(s string) any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.metrics[s]
 }
 
 func testDeps() (*common.Config, common.Metrics, common.Logger) {
@@ -210,6 +305,7 @@ func testDeps() (*common.Config, common.Metrics, common.Logger) {
 			SnowflakeAccount:   "testaccount",
 			SnowflakeUser:      "testuser",
 			SnowflakeWarehouse: "testwh",
+			PreflightMode:      PreflightOff,
 			SnowflakePrivateKey: `MIIBUwIBADANBgkqhkiG9w0BAQEFAASCAT0wggE5AgEAAkEAxIXbFdo7AhvdobX4
 F+gjkgGD3wM2zH6GhvJSnCLmKvlYPGwwX9J+xgEBPLSEH4R4zW/YFySOYxGU/Dbo
 ZIpXfwIDAQABAkBKOch643cgH8hBGMrAtNQihGH7bGpZKHzFIWdkQ6YtmmBu/O5F
@@ -228,3 +324,31 @@ jmMHJqy7ow==`,
 	}
 	return conf, &testMetrics{}, &testLogger{}
 }
+
+// recordSpans installs a tracer provider with an in-memory exporter for the duration of the test
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return exporter
+}
+
+// spanNamed returns the first recorded span with the given name, or nil
+func spanNamed(exporter *tracetest.InMemoryExporter, name string) *tracetest.SpanStub {
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return &span
+		}
+	}
+	return nil
+}
+
+func spanAttr(span *tracetest.SpanStub, key string) any {
+	for _, kv := range span.Attributes {
+		if kv.Key == attribute.Key(key) {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"os"
+
+	common "github.com/mimiro-io/common-datalayer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mimiro-io/snowflake-datalayer"
+
+// tracing exporters
+const (
+	TracingNone   = "none"
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+type tracingConfig struct {
+	exporter    string
+	endpoint    string
+	sampleRatio float64
+}
+
+// tracingConfigOf reads the tracing settings from the system config
+func tracingConfigOf(conf *common.Config) *tracingConfig {
+	return &tracingConfig{
+		exporter:    confString(conf, TracingExporter),
+		endpoint:    confString(conf, TracingEndpoint),
+		sampleRatio: confFloat(conf, TracingSampleRatio),
+	}
+}
+
+// newTracerProvider creates a tracer provider with the configured exporter.
+// It returns nil when tracing is off, then the global otel provider is left as it is.
+func newTracerProvider(tc *tracingConfig, serviceName string) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch tc.exporter {
+	case TracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingOTLP:
+		// without endpoint, the exporter uses the OTEL_EXPORTER_OTLP_* environment variables
+		var opts []otlptracehttp.Option
+		if tc.endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(tc.endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tc.sampleRatio))),
+	), nil
+}
+
+// startTracing installs the configured tracer provider as global otel provider
+func (dl *SnowflakeDataLayer) startTracing() error {
+	tp, err := newTracerProvider(tracingConfigOf(dl.config), dl.serviceName())
+	if err != nil || tp == nil {
+		return err
+	}
+	otel.SetTracerProvider(tp)
+	dl.tracerProvider = tp
+	return nil
+}
+
+// stopTracing flushes the remaining spans
+func (dl *SnowflakeDataLayer) stopTracing(ctx context.Context) error {
+	if dl.tracerProvider == nil {
+		return nil
+	}
+	return dl.tracerProvider.Shutdown(ctx)
+}
+
+// startSpan starts a span of the global otel tracer, with the dataset as attribute.
+// The tracer is looked up per span, so that a provider set later, e.g. in tests, is used.
+func startSpan(ctx context.Context, name string, dataset string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithAttributes(append([]attribute.KeyValue{attribute.String("dataset", dataset)}, attrs...)...))
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
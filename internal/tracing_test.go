@@ -0,0 +1,59 @@
+// Copyright 2024 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	t.Run("should not create a provider without exporter", func(t *testing.T) {
+		conf, _, _ := testDeps()
+		tp, err := newTracerProvider(tracingConfigOf(conf), "test")
+		if err != nil || tp != nil {
+			t.Fatalf("expected no provider, got %v, %v", tp, err)
+		}
+	})
+	t.Run("should create a provider for the stdout exporter", func(t *testing.T) {
+		conf, _, _ := testDeps()
+		conf.NativeSystemConfig[TracingExporter] = TracingStdout
+		conf.NativeSystemConfig[TracingSampleRatio] = 0.5
+		tc := tracingConfigOf(conf)
+		if tc.sampleRatio != 0.5 {
+			t.Fatalf("expected sample ratio 0.5, got %v", tc.sampleRatio)
+		}
+		tp, err := newTracerProvider(tc, "test")
+		if err != nil || tp == nil {
+			t.Fatalf("expected provider, got %v, %v", tp, err)
+		}
+		if err := tp.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("should reject invalid tracing config", func(t *testing.T) {
+		for key, value := range map[string]any{
+			TracingExporter:    "jaeger",
+			TracingEndpoint:    4318,
+			TracingSampleRatio: 1.5,
+		} {
+			conf, _, _ := testDeps()
+			conf.NativeSystemConfig[key] = value
+			if err := validateConfig(conf); err == nil {
+				t.Fatalf("expected %s %v to be rejected", key, value)
+			}
+		}
+	})
+}